@@ -3,17 +3,17 @@ package generators
 import (
 	"bytes"
 	"fmt"
-	"io/ioutil"
-	"os"
-	"os/exec"
+	"math"
+	"path/filepath"
 
-	"github.com/skx/bfcc/lexer"
+	"github.com/skx/bfcc/ir"
 )
 
 // GeneratorASM is a generator that will produce an x86-64 assembly-language
 // version of the specified input-program.
 //
-// The assembly language file will be compiled by gcc.
+// The assembly language file will be compiled by gcc, or the compiler
+// chosen in our options.
 type GeneratorASM struct {
 
 	// input source
@@ -21,133 +21,337 @@ type GeneratorASM struct {
 
 	// file to write to
 	output string
+
+	// options controls how we generate our program
+	options Options
+
+	// kept is the path of the source-file we compiled, if we
+	// didn't remove it.
+	kept string
+
+	// labels is the number of loops we've generated, used to give
+	// each one a unique label.
+	labels int
+
+	// size is the width of each cell, in bits.
+	size int
+
+	// mode describes how we handle the edges of the tape.
+	mode string
+
+	// bounds holds the instructions we've generated bounds-checks
+	// for, so that we can report their positions on failure.
+	bounds []*ir.Instruction
+}
+
+// asmCell describes how we access cells of a particular width.
+type asmCell struct {
+
+	// ptr is the size-prefix used when accessing a cell in memory.
+	ptr string
+
+	// reg is the register we use to hold the contents of a cell.
+	reg string
+
+	// load is the instruction which loads a cell into a register,
+	// zero-extending it to at least 32-bits.
+	load string
+
+	// acc is the register populated by load.
+	acc string
+
+	// data is the directive which reserves storage for a cell.
+	data string
+}
+
+// outputBufferSize is the number of bytes of output our programs collect
+// before writing them.
+//
+// Output is also written before we wait for more input, and at exit.
+const outputBufferSize = 4096
+
+// inputBufferSize is the largest number of bytes of input our programs
+// read at once.
+//
+// A read returns whatever is available, so when the input is a terminal
+// this is typically a single line.
+const inputBufferSize = 4096
+
+// asmCells holds the details of each supported cell-width.
+var asmCells = map[int]asmCell{
+	8:  {ptr: "byte ptr", reg: "%al", load: "movzx %eax, byte ptr", acc: "%eax", data: ".byte"},
+	16: {ptr: "word ptr", reg: "%ax", load: "movzx %eax, word ptr", acc: "%eax", data: ".short"},
+	32: {ptr: "dword ptr", reg: "%eax", load: "mov %eax, dword ptr", acc: "%eax", data: ".long"},
+	64: {ptr: "qword ptr", reg: "%rax", load: "mov %rax, qword ptr", acc: "%rax", data: ".quad"},
 }
 
-// generateSource produces a version of the program as X86-64 assembly language.
-func (g *GeneratorASM) generateSource() error {
+// source produces a version of the program as X86-64 assembly language.
+func (g *GeneratorASM) source() (string, error) {
+
+	//
+	// Our tape lives in the .bss section, so it cannot grow.
+	//
+	if g.options.Tape == TapeGrow {
+		return "", &UnsupportedError{Backend: "asm", Feature: "a growing tape"}
+	}
+
 	var buff bytes.Buffer
 	var programStart = `
 .intel_syntax noprefix
 .global _start
 
 write_to_stdout:
-  mov %rax, 1
-  mov %rdi, 1
-  mov %rsi, %r8
-  mov %rdx, 1
+  mov %%rax, qword ptr output_len
+  mov %%cl, byte ptr [%%r8]
+  lea %%rdx, output_buffer
+  mov byte ptr [%%rdx+%%rax], %%cl
+  inc %%rax
+  mov qword ptr output_len, %%rax
+  cmp %%rax, %d
+  je flush_output
+  ret
+
+flush_output:
+  lea %%rsi, output_buffer
+  mov %%rdx, qword ptr output_len
+flush_loop:
+  test %%rdx, %%rdx
+  jle flush_done
+  mov %%rax, 1
+  mov %%rdi, 1
   syscall
+  test %%rax, %%rax
+  jle flush_done
+  add %%rsi, %%rax
+  sub %%rdx, %%rax
+  jmp flush_loop
+flush_done:
+  mov qword ptr output_len, 0
   ret
 
 read_from_stdin:
-  mov %rax, 0
-  mov %rdi, 0
-  mov %rsi, %r8
-  mov %rdx, 1
+  mov %%rax, qword ptr input_pos
+  cmp %%rax, qword ptr input_len
+  jl read_next
+  call flush_output
+  mov %%rax, 0
+  mov %%rdi, 0
+  lea %%rsi, input_buffer
+  mov %%rdx, %d
   syscall
+  cmp %%rax, 0
+  jle read_eof
+  mov qword ptr input_len, %%rax
+  mov %%rax, 0
+read_next:
+  lea %%rdx, input_buffer
+  add %%rdx, %%rax
+  inc %%rax
+  mov qword ptr input_pos, %%rax
+  movzx %%eax, byte ptr [%%rdx]
+  mov %s [%%r8], %s
   ret
+read_eof:
+%s  ret
 
 _start:
-  lea %r8, stack
+  lea %%r8, stack
 `
-	buff.WriteString(programStart)
-
 	//
-	// Should we generate a debug-breakpoint?
+	// The width of our cells affects how we access them.
 	//
-	debug := os.Getenv("DEBUG")
-	if debug == "1" {
-		buff.WriteString("  int3\n")
-	}
+	g.size = g.options.CellSize
+	cell := asmCells[g.size]
 
 	//
-	// Keep track of "[" here.
-	//
-	// These are loop opens.
+	// What happens when we read at EOF?
 	//
-	opens := []int{}
+	eof := ""
+	switch g.options.EOF {
+	case EOFZero:
+		eof = fmt.Sprintf("  mov %s [%%r8], 0\n", cell.ptr)
+	case EOFMinusOne:
+		eof = fmt.Sprintf("  mov %s [%%r8], -1\n", cell.ptr)
+	}
+
+	buff.WriteString(fmt.Sprintf(programStart, outputBufferSize, inputBufferSize, cell.ptr, cell.reg, eof))
 
 	//
-	// Create a lexer for the input program
+	// Should we generate a debug-breakpoint?
 	//
-	l := lexer.New(g.input)
+	if g.options.Debug {
+		buff.WriteString("  int3\n")
+	}
 
 	//
-	// Program consists of all tokens
+	// Parse the input program into our intermediate form.
 	//
-	program := l.Tokens()
+	program, err := parse(g.input, g.options.Optimization)
+	if err != nil {
+		return "", err
+	}
 
 	//
-	// We keep track of the loop-labels here.
-	//
-	// Each time we see a new loop-open "[" we bump this
-	// by one.
+	// Output the instructions.
 	//
-	i := 0
+	g.labels = 0
+	g.mode = g.options.Tape
+	g.bounds = nil
+	g.generateInstructions(&buff, program)
+
+	// terminate, once any pending output has been written
+	buff.WriteString("  call flush_output\n")
+	buff.WriteString("  mov %rax, 60\n")
+	buff.WriteString("  mov %rdi, 0\n")
+	buff.WriteString("  syscall\n")
 
 	//
-	// We'll process the complete program until
-	// we hit an end of file/input
+	// If we generated any bounds-checks then each of them
+	// needs a message, which we write to STDERR before we
+	// terminate.
 	//
-	offset := 0
-	for offset < len(program) {
+	if len(g.bounds) > 0 {
+		for n := range g.bounds {
+			buff.WriteString(fmt.Sprintf("bounds_%d:\n", n+1))
+			buff.WriteString(fmt.Sprintf("  lea %%rsi, bounds_msg_%d\n", n+1))
+			buff.WriteString(fmt.Sprintf("  mov %%rdx, offset bounds_len_%d\n", n+1))
+			buff.WriteString("  jmp bounds_error\n")
+		}
+		buff.WriteString("bounds_error:\n")
+		buff.WriteString("  push %rsi\n")
+		buff.WriteString("  push %rdx\n")
+		buff.WriteString("  call flush_output\n")
+		buff.WriteString("  pop %rdx\n")
+		buff.WriteString("  pop %rsi\n")
+		buff.WriteString("  mov %rax, 1\n")
+		buff.WriteString("  mov %rdi, 2\n")
+		buff.WriteString("  syscall\n")
+		buff.WriteString("  mov %rax, 60\n")
+		buff.WriteString(fmt.Sprintf("  mov %%rdi, %d\n", BoundsExitCode))
+		buff.WriteString("  syscall\n")
+
+		buff.WriteString(".data\n")
+		for n, ins := range g.bounds {
+			err := &BoundsError{Line: ins.Line, Column: ins.Column}
+			buff.WriteString(fmt.Sprintf("bounds_msg_%d:\n", n+1))
+			buff.WriteString(fmt.Sprintf(" .ascii \"%s\\n\"\n", err.Error()))
+			buff.WriteString(fmt.Sprintf(" bounds_len_%d = . - bounds_msg_%d\n", n+1, n+1))
+		}
+	}
 
-		//
-		// The current token
-		//
-		tok := program[offset]
+	buff.WriteString(".bss\n")
+	buff.WriteString("input_pos:\n")
+	buff.WriteString(" .quad 0x0\n")
+	buff.WriteString("input_len:\n")
+	buff.WriteString(" .quad 0x0\n")
+	buff.WriteString("input_buffer:\n")
+	buff.WriteString(fmt.Sprintf(" .skip %d\n", inputBufferSize))
+	buff.WriteString("output_len:\n")
+	buff.WriteString(" .quad 0x0\n")
+	buff.WriteString("output_buffer:\n")
+	buff.WriteString(fmt.Sprintf(" .skip %d\n", outputBufferSize))
+	buff.WriteString("stack:\n")
+	buff.WriteString(fmt.Sprintf(".rept %d\n", g.options.TapeSize))
+	buff.WriteString(fmt.Sprintf(" %s 0x0\n", cell.data))
+	buff.WriteString(".endr\n")
+
+	return buff.String(), nil
+}
+
+// Source returns the source-code we'd compile for the given program,
+// without compiling it.
+func (g *GeneratorASM) Source(input string, options Options) (string, error) {
+	g.input = input
+	g.options = options
+
+	err := options.Validate()
+	if err != nil {
+		return "", err
+	}
+	return g.source()
+}
+
+// generateInstructions writes the assembly language for the given
+// instructions to the buffer.
+//
+// Loops are handled by calling ourselves recursively for their body.
+func (g *GeneratorASM) generateInstructions(buff *bytes.Buffer, program []*ir.Instruction) {
+
+	cell := asmCells[g.size]
+
+	for _, ins := range program {
 
 		//
-		// Output different things depending on the token-type
+		// Output different things depending on the instruction-type
 		//
-		switch tok.Type {
+		switch ins.Kind {
 
-		case lexer.INC_PTR:
-			buff.WriteString(fmt.Sprintf("  add %%r8, %d\n", tok.Repeat))
+		case ir.MovePtr:
+			if ins.Value > 0 {
+				buff.WriteString(fmt.Sprintf("  add %%r8, %d\n", ins.Value*g.size/8))
+			} else {
+				buff.WriteString(fmt.Sprintf("  sub %%r8, %d\n", -ins.Value*g.size/8))
+			}
+			g.moved(buff, ins, ins.Value*g.size/8)
+
+		case ir.AddCell:
+			addr := g.access(buff, ins, ins.Offset)
+			if ins.Value > 0 {
+				g.arith(buff, "add", addr, ins.Value)
+			} else {
+				g.arith(buff, "sub", addr, -ins.Value)
+			}
 
-		case lexer.DEC_PTR:
-			buff.WriteString(fmt.Sprintf("  sub %%r8, %d\n", tok.Repeat))
+		case ir.SetCell:
+			addr := g.access(buff, ins, ins.Offset)
+			g.arith(buff, "mov", addr, ins.Value)
 
-		case lexer.INC_CELL:
-			buff.WriteString(fmt.Sprintf("  add byte ptr [%%r8], %d\n", tok.Repeat))
+		case ir.MulAdd:
 
-		case lexer.DEC_CELL:
-			buff.WriteString(fmt.Sprintf("  sub byte ptr [%%r8], %d\n", tok.Repeat))
+			//
+			// Load the current cell, multiply it, and add the
+			// result to the target cell.
+			//
+			// Only the low bits of the result matter, so
+			// we don't need to worry about overflow.
+			//
+			addr := g.access(buff, ins, ins.Offset)
+			buff.WriteString(fmt.Sprintf("  %s [%%r8]\n", cell.load))
+			switch ins.Value {
+			case 1:
+				buff.WriteString(fmt.Sprintf("  add %s, %s\n", addr, cell.reg))
+			case -1:
+				buff.WriteString(fmt.Sprintf("  sub %s, %s\n", addr, cell.reg))
+			default:
+				buff.WriteString(fmt.Sprintf("  imul %s, %s, %d\n", cell.acc, cell.acc, ins.Value))
+				buff.WriteString(fmt.Sprintf("  add %s, %s\n", addr, cell.reg))
+			}
 
-		case lexer.OUTPUT:
-			buff.WriteString("  call write_to_stdout\n")
-		case lexer.INPUT:
-			buff.WriteString("  call read_from_stdin\n")
-		case lexer.LOOP_OPEN:
+		case ir.Scan:
 
 			//
-			// We sneekily optimize "[-]" by converting it
-			// into "move register, 0"
+			// Move the pointer until we find a zero-cell.
 			//
-			// Since this involves looking at future-tokens
-			// we need to make sure we're not at the end of
-			// the program.
+			// This is a loop like any other, but it is
+			// small enough that we keep the test in a
+			// single place.
 			//
-			if offset+2 < len(program) {
-
-				//
-				// Look for the next two tokens "-]", if
-				// we find them then we're looking at "[-]"
-				// which is something we can optimize.
-				//
-				if program[offset+1].Type == lexer.DEC_CELL &&
-					program[offset+2].Type == lexer.LOOP_CLOSE {
-					// register == zero
-					buff.WriteString("  mov byte ptr [%r8], 0\n\n")
-
-					// 1. Skip this instruction,
-					// 2. the next one "-"
-					// 3. and the final one "]"
-					offset += 3
-
-					// And continue the loop again.
-					continue
-				}
-			}
+			g.labels++
+			id := g.labels
+			buff.WriteString(fmt.Sprintf("  sub %%r8, %d\n", ins.Value*g.size/8))
+			buff.WriteString(fmt.Sprintf("scan_loop_%d:\n", id))
+			buff.WriteString(fmt.Sprintf("  add %%r8, %d\n", ins.Value*g.size/8))
+			g.moved(buff, ins, ins.Value*g.size/8)
+			buff.WriteString(fmt.Sprintf("  cmp %s, 0\n", g.cell(0)))
+			buff.WriteString(fmt.Sprintf("  jne scan_loop_%d\n", id))
+
+		case ir.Output:
+			buff.WriteString("  call write_to_stdout\n")
+
+		case ir.Input:
+			buff.WriteString("  call read_from_stdin\n")
+
+		case ir.Loop:
 
 			//
 			// Open of a block.
@@ -158,36 +362,13 @@ _start:
 			// NOTE: We repeat the test at the end of the
 			// loop so the label here is AFTER our condition
 			//
-			i++
-			buff.WriteString("  cmp byte ptr [%r8], 0\n")
-			buff.WriteString(fmt.Sprintf("  je close_loop_%d\n", i))
-			buff.WriteString(fmt.Sprintf("label_loop_%d:\n", i))
-			opens = append(opens, i)
-
-		case lexer.LOOP_CLOSE:
-
-			// "]" can only follow an "[".
-			//
-			// Every time we see a "[" we save the ID onto a
-			// temporary stack.  So we're gonna go back to the
-			// most recent open.
-			//
-			// This will cope with nesting.
-			//
-			if len(opens) < 1 {
-				fmt.Printf("close before open.  bug?  bogus program?\n")
-				os.Exit(1)
-			}
+			g.labels++
+			id := g.labels
+			buff.WriteString(fmt.Sprintf("  cmp %s, 0\n", g.cell(0)))
+			buff.WriteString(fmt.Sprintf("  je close_loop_%d\n", id))
+			buff.WriteString(fmt.Sprintf("label_loop_%d:\n", id))
 
-			//
-			// Get the last label-ID
-			//
-			last := opens[len(opens)-1]
-
-			//
-			// Remove it from our list now.
-			//
-			opens = opens[:len(opens)-1]
+			g.generateInstructions(buff, ins.Body)
 
 			//
 			// What we could do here is jump back to the
@@ -210,72 +391,174 @@ _start:
 			// test at the start of the loop, because
 			// running it twice would be pointless.
 			//
-			buff.WriteString("  cmp byte ptr [r8], 0\n")
+			buff.WriteString(fmt.Sprintf("  cmp %s, 0\n", g.cell(0)))
+			buff.WriteString(fmt.Sprintf("  jne label_loop_%d\n", id))
+			buff.WriteString(fmt.Sprintf("close_loop_%d:\n", id))
+		}
+	}
+}
 
-			buff.WriteString(fmt.Sprintf("  jne label_loop_%d\n", last))
-			buff.WriteString(fmt.Sprintf("close_loop_%d:\n", last))
+// cell returns the address of the cell at the given offset from the
+// memory-pointer, prefixed by the size of the cell.
+func (g *GeneratorASM) cell(offset int) string {
+	ptr := asmCells[g.size].ptr
+	if offset == 0 {
+		return ptr + " [%r8]"
+	}
+	return fmt.Sprintf("%s [%%r8%+d]", ptr, offset*g.size/8)
+}
 
-		default:
-			fmt.Printf("token not handled: %v\n", tok)
-			os.Exit(1)
+// access writes any code which is required before the cell at the given
+// offset from the memory-pointer is accessed, and returns the operand
+// which refers to that cell.
+//
+// When bounds-checking we ensure the cell is within the tape, and when
+// the tape wraps around we calculate the address of the cell in %rcx.
+func (g *GeneratorASM) access(buff *bytes.Buffer, ins *ir.Instruction, offset int) string {
+	switch g.mode {
+	case TapeCheck:
+		g.checkBounds(buff, ins, offset)
+	case TapeWrap:
+		if offset != 0 {
+			g.wrap(buff, "%rcx", offset*g.size/8, offset*g.size/8)
+			return asmCells[g.size].ptr + " [%rcx]"
 		}
+	}
+	return g.cell(offset)
+}
 
-		//
-		// Keep processing
-		//
-		offset++
+// moved writes any code which is required after the memory-pointer has
+// been changed by the given number of bytes.
+func (g *GeneratorASM) moved(buff *bytes.Buffer, ins *ir.Instruction, bytes int) {
+	switch g.mode {
+	case TapeCheck:
+		g.checkBounds(buff, ins, 0)
+	case TapeWrap:
+		g.wrap(buff, "%r8", 0, bytes)
 	}
+}
 
-	// terminate
-	buff.WriteString("  mov %rax, 60\n")
-	buff.WriteString("  mov %rdi, 0\n")
-	buff.WriteString("  syscall\n")
+// checkBounds writes code which terminates the program if the cell at
+// the given offset from the memory-pointer is outside the tape.
+func (g *GeneratorASM) checkBounds(buff *bytes.Buffer, ins *ir.Instruction, offset int) {
 
-	buff.WriteString(".bss\n")
-	buff.WriteString("stack:\n")
-	buff.WriteString(".rept 30000\n")
-	buff.WriteString(" .byte 0x0\n")
-	buff.WriteString(".endr\n")
+	g.bounds = append(g.bounds, ins)
+	id := len(g.bounds)
+
+	//
+	// Work out the distance of the cell from the start of the
+	// tape.  Comparing that as an unsigned value catches cells
+	// which are before the tape, as well as after it.
+	//
+	buff.WriteString(fmt.Sprintf("  lea %%rax, [%%r8%+d]\n", offset*g.size/8))
+	buff.WriteString("  lea %rdx, stack\n")
+	buff.WriteString("  sub %rax, %rdx\n")
+	buff.WriteString(fmt.Sprintf("  mov %%rdx, %d\n", g.options.TapeSize*g.size/8))
+	buff.WriteString("  cmp %rax, %rdx\n")
+	buff.WriteString(fmt.Sprintf("  jae bounds_%d\n", id))
+}
+
+// wrap writes code which stores the address of the cell the given number
+// of bytes away from the memory-pointer in reg, wrapping around the ends
+// of the tape.
+//
+// The distance is the furthest that address might be outside the tape,
+// in either direction.
+func (g *GeneratorASM) wrap(buff *bytes.Buffer, reg string, offset int, distance int) {
 
-	// Output to a file
-	err := ioutil.WriteFile(g.output+".s", buff.Bytes(), 0644)
-	return err
+	size := g.options.TapeSize * g.size / 8
+
+	//
+	// Get the distance of the cell from the start of the tape.
+	//
+	if reg != "%r8" || offset != 0 {
+		buff.WriteString(fmt.Sprintf("  lea %s, [%%r8%+d]\n", reg, offset))
+	}
+	buff.WriteString("  lea %rdx, stack\n")
+	buff.WriteString(fmt.Sprintf("  sub %s, %%rdx\n", reg))
+
+	//
+	// If we might have moved further than the size of the tape
+	// we need to divide to get the remainder.
+	//
+	// Otherwise, and afterwards, we're at most one tape-length
+	// away from where we should be.
+	//
+	if distance <= -size || distance >= size {
+		buff.WriteString(fmt.Sprintf("  mov %%rax, %s\n", reg))
+		buff.WriteString("  cqo\n")
+		buff.WriteString(fmt.Sprintf("  mov %%rsi, %d\n", size))
+		buff.WriteString("  idiv %rsi\n")
+		buff.WriteString(fmt.Sprintf("  mov %s, %%rdx\n", reg))
+		buff.WriteString("  lea %rdx, stack\n")
+	}
+	buff.WriteString(fmt.Sprintf("  lea %%rax, [%s+%d]\n", reg, size))
+	buff.WriteString(fmt.Sprintf("  test %s, %s\n", reg, reg))
+	buff.WriteString(fmt.Sprintf("  cmovs %s, %%rax\n", reg))
+	buff.WriteString(fmt.Sprintf("  lea %%rax, [%s-%d]\n", reg, size))
+	buff.WriteString(fmt.Sprintf("  cmp %s, %d\n", reg, size))
+	buff.WriteString(fmt.Sprintf("  cmovge %s, %%rax\n", reg))
+	buff.WriteString(fmt.Sprintf("  add %s, %%rdx\n", reg))
 }
 
-// compileSource passes our generated source-program through `gcc`
-// to compile it to an executable.
-func (g *GeneratorASM) compileSource() error {
+// arith writes an instruction which applies the given operation, with
+// a constant value, to a cell.
+//
+// The value is truncated to the width of our cells.  x86-64 cannot use
+// a 64-bit immediate value with a memory operand, so if the value is too
+// large we go via a register instead.
+func (g *GeneratorASM) arith(buff *bytes.Buffer, op string, cell string, value int) {
 
-	// Use gcc to compile our object-code
-	gcc := exec.Command(
-		"gcc",
+	if g.size < 64 {
+		value &= (1 << uint(g.size)) - 1
+	}
+
+	if g.size == 64 && (value > math.MaxInt32 || value < math.MinInt32) {
+		buff.WriteString(fmt.Sprintf("  mov %%rax, %d\n", value))
+		buff.WriteString(fmt.Sprintf("  %s %s, %%rax\n", op, cell))
+		return
+	}
+
+	buff.WriteString(fmt.Sprintf("  %s %s, %d\n", op, cell, value))
+}
+
+// compileSource passes our generated source-program through the
+// compiler to produce an executable.
+func (g *GeneratorASM) compileSource(path string) error {
+
+	// Our program provides its own entry-point, and uses no
+	// libraries, so these flags are always required.
+	args := []string{
 		"-static",
 		"-fPIC",
 		"-nostdlib",
 		"-nostartfiles",
 		"-nodefaultlibs",
-		"-o", g.output,
-		g.output+".s")
+	}
+	args = append(args, g.options.CFlags...)
+	args = append(args, "-o", g.output, path)
+	args = append(args, g.options.LDFlags...)
 
-	gcc.Stdout = os.Stdout
-	gcc.Stderr = os.Stderr
+	// Use the compiler to assemble and link our code
+	compiler := g.options.compiler()
+	cc, err := command(compiler[0], append(compiler[1:], args...)...)
+	if err != nil {
+		return err
+	}
 
-	err := gcc.Run()
+	err = cc.Run()
 	if err != nil {
 		return err
 	}
 
 	// Strip the binary - unless compiling for debug-usage
-	debug := os.Getenv("DEBUG")
-	if debug == "0" {
-		strip := exec.Command("strip", g.output)
-		strip.Stdout = os.Stdout
-		strip.Stderr = os.Stderr
-
-		err = strip.Run()
+	if !g.options.Debug {
+		strip, err := command("strip", g.output)
 		if err != nil {
 			return err
 		}
+
+		return strip.Run()
 	}
 	return nil
 }
@@ -284,43 +567,52 @@ func (g *GeneratorASM) compileSource() error {
 // binary to the named output-path.
 //
 // We generate a temporary file, write our assembly language file to that
-// and then compile via gcc.
-func (g *GeneratorASM) Generate(input string, output string) error {
+// and then compile via the compiler named in our options.
+func (g *GeneratorASM) Generate(input string, output string, options Options) error {
 
 	//
-	// Save the input and output path away.
+	// Save the input and output path away, along with our options.
 	//
 	g.input = input
 	g.output = output
+	g.options = options
+	g.kept = ""
+
+	err := options.Validate()
+	if err != nil {
+		return err
+	}
 
 	//
 	// Generate our output program
 	//
-	err := g.generateSource()
+	src, err := g.source()
 	if err != nil {
 		return err
 	}
 
 	//
-	// Compile it
+	// Write it to a temporary file, which is removed once
+	// we're done, even if we failed to compile it.
 	//
-	err = g.compileSource()
+	path, err := writeSource(src, filepath.Base(output)+".s")
 	if err != nil {
 		return err
 	}
+	defer func() {
+		g.kept = removeSource(path, options)
+	}()
 
 	//
-	// Cleanup our source file?  Or leave it alone
-	// and output the path of the source-file we generated.
+	// Compile it
 	//
-	clean := os.Getenv("CLEANUP")
-	if clean == "1" {
-		os.Remove(g.output + ".s")
-	} else {
-		fmt.Printf("generated source file at %s\n", g.output+".s")
-	}
+	return g.compileSource(path)
+}
 
-	return nil
+// KeptSource returns the path of the source-file we compiled, if the
+// options we were last used with disabled cleanup.
+func (g *GeneratorASM) KeptSource() string {
+	return g.kept
 }
 
 // Register our back-end
@@ -3,198 +3,374 @@ package generators
 import (
 	"bytes"
 	"fmt"
-	"io/ioutil"
-	"os"
-	"os/exec"
+	"path/filepath"
+	"strings"
 
-	"github.com/skx/bfcc/lexer"
+	"github.com/skx/bfcc/ir"
 )
 
 // GeneratorC is a generator that will produce an C version of the specified
 // input-program.
 //
-// The C-source will then be compiled by gcc.
+// The C-source will then be compiled by gcc, or the compiler chosen in
+// our options.
 type GeneratorC struct {
 	// input source
 	input string
 
 	// file to write to
 	output string
+
+	// options controls how we generate our program
+	options Options
+
+	// kept is the path of the source-file we compiled, if we
+	// didn't remove it.
+	kept string
+
+	// size is the width of each cell, in bits.
+	size int
+
+	// mode describes how we handle the edges of the tape.
+	mode string
 }
 
-// generateSource produces a version of the program as C source-file
-func (c *GeneratorC) generateSource() error {
+// cTypes holds the C-type we use for each supported cell-width.
+//
+// We always use unsigned types, so that wraparound is well-defined.
+var cTypes = map[int]string{
+	8:  "unsigned char",
+	16: "unsigned short",
+	32: "unsigned int",
+	64: "unsigned long long",
+}
+
+// source produces a version of the program as C source-code.
+func (c *GeneratorC) source() (string, error) {
 	var buff bytes.Buffer
 	var programStart = `
 extern int putchar(int);
-extern char getchar();
+extern int getchar(void);
+extern int fflush(void *);
+extern void *memchr(const void *, int, unsigned long);
 
-char array[30000];
+typedef %s cell;
 
-int idx = 0;
+%s
 
+long idx = 0;
+
+void read_input(cell *c) {
+  fflush(0);
+  int ch = getchar();
+  if (ch == -1) {
+    %s
+  } else {
+    *c = ch;
+  }
+}
+%s
 int main (int arc, char *argv[]) {
 `
-	buff.WriteString(programStart)
+	c.size = c.options.CellSize
+	c.mode = c.options.Tape
 
 	//
-	// Create a lexer for the input program
+	// A growing tape is allocated when we start, and reallocated
+	// as required, otherwise it has a fixed size.
 	//
-	l := lexer.New(c.input)
+	tape := fmt.Sprintf("cell array[%d];", c.options.TapeSize)
+	if c.mode == TapeGrow {
+		tape = fmt.Sprintf("cell *array;\nlong size = %d;", c.options.TapeSize)
+	}
 
 	//
-	// Program consists of all tokens
+	// If we're checking memory-accesses we need a helper to
+	// report failures, and if the tape wraps around we need
+	// a helper to find the position within it.
 	//
-	program := l.Tokens()
+	helpers := ""
+	switch c.mode {
+	case TapeCheck:
+		helpers = fmt.Sprintf(`
+extern int dprintf(int, const char *, ...);
+extern void exit(int);
+
+void bounds(long pos, int line, int column) {
+  if (pos < 0 || pos >= %d) {
+    fflush(0);
+    dprintf(2, "pointer out of bounds at line %%d, column %%d\n", line, column);
+    exit(%d);
+  }
+}
+`, c.options.TapeSize, BoundsExitCode)
+	case TapeGrow:
+		helpers = fmt.Sprintf(`
+extern int dprintf(int, const char *, ...);
+extern void exit(int);
+extern void *calloc(unsigned long, unsigned long);
+extern void *realloc(void *, unsigned long);
+extern void *memset(void *, int, unsigned long);
+
+void grow(long pos, int line, int column) {
+  if (pos < 0) {
+    fflush(0);
+    dprintf(2, "pointer out of bounds at line %%d, column %%d\n", line, column);
+    exit(%d);
+  }
+  if (pos < size) {
+    return;
+  }
+  long n = size;
+  while (n <= pos) {
+    n *= 2;
+  }
+  array = realloc(array, n * sizeof(cell));
+  if (!array) {
+    dprintf(2, "out of memory\n");
+    exit(1);
+  }
+  memset(array + size, 0, (n - size) * sizeof(cell));
+  size = n;
+}
+`, BoundsExitCode)
+	case TapeWrap:
+		helpers = fmt.Sprintf(`
+long wrap(long pos) {
+  pos %%= %d;
+  if (pos < 0) {
+    pos += %d;
+  }
+  return pos;
+}
+`, c.options.TapeSize, c.options.TapeSize)
+	}
 
 	//
-	// We'll process the complete program until
-	// we hit an end of file/input
+	// What happens when we read at EOF?
 	//
-	offset := 0
-	for offset < len(program) {
+	eof := "/* leave the cell unchanged */"
+	switch c.options.EOF {
+	case EOFZero:
+		eof = "*c = 0;"
+	case EOFMinusOne:
+		eof = "*c = (cell)-1;"
+	}
 
-		//
-		// The current token
-		//
-		tok := program[offset]
+	buff.WriteString(fmt.Sprintf(programStart, cTypes[c.size], tape, eof, helpers))
+	if c.mode == TapeGrow {
+		buff.WriteString("  array = calloc(size, sizeof(cell));\n")
+	}
 
-		//
-		// Output different things depending on the token-type
-		//
-		switch tok.Type {
+	//
+	// Parse the input program into our intermediate form.
+	//
+	program, err := parse(c.input, c.options.Optimization)
+	if err != nil {
+		return "", err
+	}
 
-		case lexer.INC_PTR:
-			buff.WriteString(fmt.Sprintf("  idx += %d;\n", tok.Repeat))
-		case lexer.DEC_PTR:
-			buff.WriteString(fmt.Sprintf("  idx -= %d;\n", tok.Repeat))
-		case lexer.INC_CELL:
-			buff.WriteString(fmt.Sprintf("  array[idx] += %d;\n", tok.Repeat))
-		case lexer.DEC_CELL:
-			buff.WriteString(fmt.Sprintf("  array[idx] -= %d;\n", tok.Repeat))
-		case lexer.OUTPUT:
-			buff.WriteString("  putchar(array[idx]);\n")
+	//
+	// Output the instructions.
+	//
+	c.generateInstructions(&buff, program, 1)
 
-		case lexer.INPUT:
-			buff.WriteString("  array[idx] = getchar();\n")
+	// Close the main-function
+	buff.WriteString("}\n")
 
-		case lexer.LOOP_OPEN:
+	return buff.String(), nil
+}
 
-			//
-			// We sneekily optimize "[-]" by converting it
-			// into an explicit setting of the cell-content
-			// to zero.
-			//
-			// Since this involves looking at future-tokens
-			// we need to make sure we're not at the end of
-			// the program.
-			//
-			if offset+2 < len(program) {
-
-				//
-				// Look for the next two tokens "-]", if
-				// we find them then we're looking at "[-]"
-				// which is something we can optimize.
-				//
-				if program[offset+1].Type == lexer.DEC_CELL &&
-					program[offset+2].Type == lexer.LOOP_CLOSE {
-					// register == zero
-					buff.WriteString("  array[idx] = 0;\n")
-
-					// 1. Skip this instruction,
-					// 2. the next one "-"
-					// 3. and the final one "]"
-					offset += 3
-
-					// And continue the loop again.
-					continue
-				}
-			}
+// Source returns the source-code we'd compile for the given program,
+// without compiling it.
+func (c *GeneratorC) Source(input string, options Options) (string, error) {
+	c.input = input
+	c.options = options
+
+	err := options.Validate()
+	if err != nil {
+		return "", err
+	}
+	return c.source()
+}
 
-			buff.WriteString("  while (array[idx]) {\n")
+// generateInstructions writes the C-source for the given instructions
+// to the buffer, indented by the given depth.
+//
+// Loops are handled by calling ourselves recursively for their body.
+func (c *GeneratorC) generateInstructions(buff *bytes.Buffer, program []*ir.Instruction, depth int) {
 
-		case lexer.LOOP_CLOSE:
-			buff.WriteString("}\n")
+	indent := strings.Repeat("  ", depth)
 
-		default:
-			fmt.Printf("token not handled: %v\n", tok)
-			os.Exit(1)
-		}
+	for _, ins := range program {
 
 		//
-		// Keep processing
+		// Output different things depending on the instruction-type
 		//
-		offset++
+		switch ins.Kind {
+
+		case ir.MovePtr:
+			c.move(buff, indent, ins)
+		case ir.AddCell:
+			c.checkBounds(buff, indent, ins, ins.Offset)
+			buff.WriteString(fmt.Sprintf("%s%s += %d;\n", indent, c.cell(ins.Offset), ins.Value))
+		case ir.SetCell:
+			c.checkBounds(buff, indent, ins, ins.Offset)
+			buff.WriteString(fmt.Sprintf("%s%s = %d;\n", indent, c.cell(ins.Offset), ins.Value))
+		case ir.MulAdd:
+			c.checkBounds(buff, indent, ins, ins.Offset)
+			buff.WriteString(fmt.Sprintf("%s%s += array[idx] * %d;\n", indent, c.cell(ins.Offset), ins.Value))
+		case ir.Scan:
+
+			//
+			// Searching rightwards for a zero-cell one step
+			// at a time can be handed off to the C library,
+			// which will do it much faster than we could.
+			//
+			// That only works when our cells are bytes, and
+			// we're not doing anything special at the edges
+			// of the tape.  There's no portable equivalent
+			// for searching leftwards, so we loop for that.
+			//
+			switch {
+			case c.mode != TapeFixed:
+				buff.WriteString(fmt.Sprintf("%swhile (array[idx]) {\n", indent))
+				c.move(buff, indent+"  ", ins)
+				buff.WriteString(fmt.Sprintf("%s}\n", indent))
+			case c.size == 8 && ins.Value == 1:
+				buff.WriteString(fmt.Sprintf("%sidx = (cell *)memchr(&array[idx], 0, sizeof(array) - idx) - array;\n", indent))
+			default:
+				buff.WriteString(fmt.Sprintf("%swhile (array[idx]) idx += %d;\n", indent, ins.Value))
+			}
+		case ir.Output:
+			buff.WriteString(fmt.Sprintf("%sputchar(array[idx]);\n", indent))
+		case ir.Input:
+			buff.WriteString(fmt.Sprintf("%sread_input(&array[idx]);\n", indent))
+		case ir.Loop:
+			buff.WriteString(fmt.Sprintf("%swhile (array[idx]) {\n", indent))
+			c.generateInstructions(buff, ins.Body, depth+1)
+			buff.WriteString(fmt.Sprintf("%s}\n", indent))
+		}
 	}
+}
 
-	// Close the main-function
-	buff.WriteString("}\n")
+// move writes the C-source to move the memory-pointer by the value of
+// the given instruction.
+func (c *GeneratorC) move(buff *bytes.Buffer, indent string, ins *ir.Instruction) {
+	if c.mode == TapeWrap {
+		buff.WriteString(fmt.Sprintf("%sidx = wrap(idx%+d);\n", indent, ins.Value))
+		return
+	}
+	buff.WriteString(fmt.Sprintf("%sidx += %d;\n", indent, ins.Value))
+	c.checkBounds(buff, indent, ins, 0)
+}
 
-	// Output to a file
-	err := ioutil.WriteFile(c.output+".c", buff.Bytes(), 0644)
-	return err
+// cell returns the C-expression for the cell at the given offset from
+// the memory-pointer.
+func (c *GeneratorC) cell(offset int) string {
+	switch {
+	case offset == 0:
+		return "array[idx]"
+	case c.mode == TapeWrap:
+		return fmt.Sprintf("array[wrap(idx%+d)]", offset)
+	}
+	return fmt.Sprintf("array[idx%+d]", offset)
 }
 
-// compileSource uses gcc to compile the generated source-code
-func (c *GeneratorC) compileSource() error {
+// checkBounds writes a call to our helper which terminates the program
+// if the cell at the given offset from the memory-pointer is outside the
+// tape.
+//
+// If the tape is growing we instead call the helper which makes it large
+// enough to contain the cell.
+//
+// In other modes nothing is written.
+func (c *GeneratorC) checkBounds(buff *bytes.Buffer, indent string, ins *ir.Instruction, offset int) {
+	switch c.mode {
+	case TapeCheck:
+		buff.WriteString(fmt.Sprintf("%sbounds(idx%+d, %d, %d);\n", indent, offset, ins.Line, ins.Column))
+	case TapeGrow:
+		buff.WriteString(fmt.Sprintf("%sgrow(idx%+d, %d, %d);\n", indent, offset, ins.Line, ins.Column))
+	}
+}
 
-	gcc := exec.Command(
-		"gcc",
-		"-static",
-		"-O3",
-		"-s",
-		"-o", c.output,
-		c.output+".c")
+// compileSource uses the compiler to compile the generated source-code
+func (c *GeneratorC) compileSource(path string) error {
+
+	// Choose the level of optimization the compiler should perform,
+	// based upon that which we've applied ourselves.
+	opt := "-O3"
+	switch c.options.Optimization {
+	case ir.O0:
+		opt = "-O0"
+	case ir.O1:
+		opt = "-O1"
+	}
 
-	gcc.Stdout = os.Stdout
-	gcc.Stderr = os.Stderr
+	args := []string{opt, "-s"}
+	args = append(args, c.options.CFlags...)
+	args = append(args, "-o", c.output, path)
+	args = append(args, c.options.LDFlags...)
 
-	err := gcc.Run()
-	return err
+	compiler := c.options.compiler()
+	cc, err := command(compiler[0], append(compiler[1:], args...)...)
+	if err != nil {
+		return err
+	}
+
+	return cc.Run()
 }
 
 // Generate takes the specified input-string and writes it as a compiled
 // binary to the named output-path.
 //
 // We generate a temporary file, write our C-source to that and then
-// compile via gcc.
-func (c *GeneratorC) Generate(input string, output string) error {
+// compile via the compiler named in our options.
+func (c *GeneratorC) Generate(input string, output string, options Options) error {
 
 	//
-	// Save the input and output path away.
+	// Save the input and output path away, along with our options.
 	//
 	c.input = input
 	c.output = output
+	c.options = options
+	c.kept = ""
+
+	err := options.Validate()
+	if err != nil {
+		return err
+	}
 
 	//
 	// Generate our output program
 	//
-	err := c.generateSource()
+	src, err := c.source()
 	if err != nil {
 		return err
 	}
 
 	//
-	// Compile it
+	// Write it to a temporary file, which is removed once
+	// we're done, even if we failed to compile it.
 	//
-	err = c.compileSource()
+	path, err := writeSource(src, filepath.Base(output)+".c")
 	if err != nil {
 		return err
 	}
+	defer func() {
+		c.kept = removeSource(path, options)
+	}()
 
 	//
-	// Cleanup our source file?  Or leave it alone
-	// and output the path of the source-file we generated.
+	// Compile it
 	//
-	clean := os.Getenv("CLEANUP")
-	if clean == "1" {
-		os.Remove(c.output + ".c")
-	} else {
-
-		fmt.Printf("generated source file at %s\n", c.output+".c")
-	}
+	return c.compileSource(path)
+}
 
-	return nil
+// KeptSource returns the path of the source-file we compiled, if the
+// options we were last used with disabled cleanup.
+func (c *GeneratorC) KeptSource() string {
+	return c.kept
 }
 
 // Register our back-end
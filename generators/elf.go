@@ -0,0 +1,930 @@
+package generators
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+
+	"github.com/skx/bfcc/ir"
+)
+
+// GeneratorELF is a generator that will produce an x86-64 executable
+// for Linux directly, without the use of any external tools.
+//
+// The code we generate is the same as that produced by the asm backend,
+// but rather than writing it as assembly language we encode the
+// machine-code ourselves, and write it to a static ELF binary.
+type GeneratorELF struct {
+
+	// input source
+	input string
+
+	// file to write to
+	output string
+
+	// options controls how we generate our program
+	options Options
+
+	// labels is the number of loops we've generated, used to give
+	// each one a unique label.
+	labels int
+
+	// size is the width of each cell, in bits.
+	size int
+
+	// mode describes how we handle the edges of the tape.
+	mode string
+
+	// bounds holds the instructions we've generated bounds-checks
+	// for, so that we can report their positions on failure.
+	bounds []*ir.Instruction
+
+	// code holds the machine-code we've generated.
+	code bytes.Buffer
+
+	// text holds the position of each label within our code.
+	text map[string]int
+
+	// fixups holds the places in our code which refer to labels,
+	// to be updated once we know where everything lives.
+	fixups []elfFixup
+}
+
+// elfBase is the address at which our executable is loaded.
+const elfBase = 0x400000
+
+// elfPage is the alignment of the segments in our executable.
+const elfPage = 0x1000
+
+// elfHeaders is the size of the ELF header, and our two program-headers,
+// which come before our code.
+const elfHeaders = 64 + 2*56
+
+// elfBSS holds the offset of each of our variables within the .bss
+// segment, which follows our code.
+//
+// The tape, named "stack" for consistency with the asm backend, comes
+// last as its size varies.
+var elfBSS = map[string]int{
+	"input_pos":     0,
+	"input_len":     8,
+	"output_len":    16,
+	"input_buffer":  24,
+	"output_buffer": 24 + inputBufferSize,
+	"stack":         24 + inputBufferSize + outputBufferSize,
+}
+
+// elfFixup describes a reference to a label, which is a four byte value
+// within our code.
+type elfFixup struct {
+
+	// pos is the position of the value within our code.
+	pos int
+
+	// label is the name of the label referred to.
+	label string
+
+	// relative is true if the value is the distance to the label
+	// from the end of the value, as used by jumps, rather than its
+	// address.
+	relative bool
+}
+
+// The registers we use, numbered as the processor does.
+const (
+	rax = 0
+	rcx = 1
+	rdx = 2
+	rsi = 6
+	rdi = 7
+	r8  = 8
+)
+
+// The condition-codes we use, for conditional jumps and moves.
+const (
+	ccAE = 0x3
+	ccE  = 0x4
+	ccNE = 0x5
+	ccS  = 0x8
+	ccL  = 0xC
+	ccGE = 0xD
+	ccLE = 0xE
+)
+
+// The arithmetic operations we use, numbered as the processor does,
+// along with an extra value for a move.
+const (
+	aluAdd = 0
+	aluSub = 5
+	aluCmp = 7
+	aluMov = -1
+)
+
+// elfOperand describes the operand of an instruction which may refer to
+// either a register, or to memory.
+type elfOperand struct {
+
+	// direct is true if the operand is the register named by reg.
+	direct bool
+	reg    int
+
+	// Otherwise the operand is the memory at the address base+index+disp,
+	// where base or index may be -1 if unused.
+	base  int
+	index int
+	disp  int
+
+	// label is set if the operand is the memory at the address of the
+	// given label.
+	label string
+}
+
+// elfReg returns an operand which refers to the given register.
+func elfReg(reg int) elfOperand {
+	return elfOperand{direct: true, reg: reg}
+}
+
+// elfMem returns an operand which refers to the memory at the given
+// distance from the address in the given register.
+func elfMem(base int, disp int) elfOperand {
+	return elfOperand{base: base, index: -1, disp: disp}
+}
+
+// elfLabel returns an operand which refers to the memory at the address
+// of the given label.
+func elfLabel(label string) elfOperand {
+	return elfOperand{base: -1, index: -1, label: label}
+}
+
+// program produces the machine-code for our program.
+//
+// This mirrors the assembly language generated by the asm backend, see
+// GeneratorASM.source, so the comments here only cover what differs.
+func (g *GeneratorELF) program() error {
+
+	if g.options.Tape == TapeGrow {
+		return &UnsupportedError{Backend: "elf", Feature: "a growing tape"}
+	}
+
+	g.code.Reset()
+	g.text = make(map[string]int)
+	g.fixups = nil
+
+	g.size = g.options.CellSize
+
+	//
+	// write_to_stdout
+	//
+	g.label("write_to_stdout")
+	g.load(64, rax, elfLabel("output_len"))
+	g.load(8, rcx, elfMem(r8, 0))
+	g.movLabel(rdx, "output_buffer")
+	g.store(8, elfOperand{base: rdx, index: rax}, rcx)
+	g.inc(rax)
+	g.store(64, elfLabel("output_len"), rax)
+	g.aluImm(aluCmp, 64, elfReg(rax), outputBufferSize)
+	g.jump(ccE, "flush_output")
+	g.ret()
+
+	//
+	// flush_output
+	//
+	g.label("flush_output")
+	g.movLabel(rsi, "output_buffer")
+	g.load(64, rdx, elfLabel("output_len"))
+	g.label("flush_loop")
+	g.test(rdx)
+	g.jump(ccLE, "flush_done")
+	g.movImm(rax, 1)
+	g.movImm(rdi, 1)
+	g.syscall()
+	g.test(rax)
+	g.jump(ccLE, "flush_done")
+	g.alu(aluAdd, 64, elfReg(rsi), rax)
+	g.alu(aluSub, 64, elfReg(rdx), rax)
+	g.jump(-1, "flush_loop")
+	g.label("flush_done")
+	g.movImmMem(64, elfLabel("output_len"), 0)
+	g.ret()
+
+	//
+	// read_from_stdin
+	//
+	g.label("read_from_stdin")
+	g.load(64, rax, elfLabel("input_pos"))
+	g.emit(64, []byte{0x3B}, rax, elfLabel("input_len"))
+	g.jump(ccL, "read_next")
+	g.call("flush_output")
+	g.movImm(rax, 0)
+	g.movImm(rdi, 0)
+	g.movLabel(rsi, "input_buffer")
+	g.movImm(rdx, inputBufferSize)
+	g.syscall()
+	g.aluImm(aluCmp, 64, elfReg(rax), 0)
+	g.jump(ccLE, "read_eof")
+	g.store(64, elfLabel("input_len"), rax)
+	g.movImm(rax, 0)
+	g.label("read_next")
+	g.movLabel(rdx, "input_buffer")
+	g.alu(aluAdd, 64, elfReg(rdx), rax)
+	g.inc(rax)
+	g.store(64, elfLabel("input_pos"), rax)
+	g.movzx(8, rax, elfMem(rdx, 0))
+	g.store(g.size, g.cell(0), rax)
+	g.ret()
+	g.label("read_eof")
+
+	//
+	// What happens when we read at EOF?
+	//
+	switch g.options.EOF {
+	case EOFZero:
+		g.movImmMem(g.size, g.cell(0), 0)
+	case EOFMinusOne:
+		g.movImmMem(g.size, g.cell(0), -1)
+	}
+	g.ret()
+
+	//
+	// _start
+	//
+	g.label("_start")
+	g.movLabel(r8, "stack")
+
+	//
+	// Should we generate a debug-breakpoint?
+	//
+	if g.options.Debug {
+		g.code.WriteByte(0xCC)
+	}
+
+	//
+	// Parse the input program into our intermediate form.
+	//
+	program, err := parse(g.input, g.options.Optimization)
+	if err != nil {
+		return err
+	}
+
+	//
+	// Output the instructions.
+	//
+	g.labels = 0
+	g.mode = g.options.Tape
+	g.bounds = nil
+	g.generateInstructions(program)
+
+	// exit
+	g.call("flush_output")
+	g.movImm(rax, 60)
+	g.movImm(rdi, 0)
+	g.syscall()
+
+	if len(g.bounds) > 0 {
+		var messages []string
+		for n, ins := range g.bounds {
+			msg := (&BoundsError{Line: ins.Line, Column: ins.Column}).Error() + "\n"
+			messages = append(messages, msg)
+
+			g.label(fmt.Sprintf("bounds_%d", n+1))
+			g.movLabel(rsi, fmt.Sprintf("bounds_msg_%d", n+1))
+			g.movImm(rdx, len(msg))
+			g.jump(-1, "bounds_error")
+		}
+		g.label("bounds_error")
+		g.push(rsi)
+		g.push(rdx)
+		g.call("flush_output")
+		g.pop(rdx)
+		g.pop(rsi)
+		g.movImm(rax, 1)
+		g.movImm(rdi, 2)
+		g.syscall()
+		g.movImm(rax, 60)
+		g.movImm(rdi, BoundsExitCode)
+		g.syscall()
+
+		//
+		// The messages follow our code.
+		//
+		for n, msg := range messages {
+			g.label(fmt.Sprintf("bounds_msg_%d", n+1))
+			g.code.WriteString(msg)
+		}
+	}
+
+	return nil
+}
+
+// generateInstructions writes the machine-code for the given
+// instructions, as GeneratorASM.generateInstructions does.
+func (g *GeneratorELF) generateInstructions(program []*ir.Instruction) {
+
+	for _, ins := range program {
+
+		switch ins.Kind {
+
+		case ir.MovePtr:
+			g.aluImm(aluAdd, 64, elfReg(r8), ins.Value*g.size/8)
+			g.moved(ins, ins.Value*g.size/8)
+
+		case ir.AddCell:
+			addr := g.access(ins, ins.Offset)
+			if ins.Value > 0 {
+				g.arith(aluAdd, addr, ins.Value)
+			} else {
+				g.arith(aluSub, addr, -ins.Value)
+			}
+
+		case ir.SetCell:
+			addr := g.access(ins, ins.Offset)
+			g.arith(aluMov, addr, ins.Value)
+
+		case ir.MulAdd:
+			addr := g.access(ins, ins.Offset)
+			if g.size < 32 {
+				g.movzx(g.size, rax, g.cell(0))
+			} else {
+				g.load(g.size, rax, g.cell(0))
+			}
+			switch ins.Value {
+			case 1:
+				g.alu(aluAdd, g.size, addr, rax)
+			case -1:
+				g.alu(aluSub, g.size, addr, rax)
+			default:
+				g.imul(rax, ins.Value)
+				g.alu(aluAdd, g.size, addr, rax)
+			}
+
+		case ir.Scan:
+			g.labels++
+			id := fmt.Sprintf("scan_loop_%d", g.labels)
+			g.aluImm(aluSub, 64, elfReg(r8), ins.Value*g.size/8)
+			g.label(id)
+			g.aluImm(aluAdd, 64, elfReg(r8), ins.Value*g.size/8)
+			g.moved(ins, ins.Value*g.size/8)
+			g.aluImm(aluCmp, g.size, g.cell(0), 0)
+			g.jump(ccNE, id)
+
+		case ir.Output:
+			g.call("write_to_stdout")
+
+		case ir.Input:
+			g.call("read_from_stdin")
+
+		case ir.Loop:
+			g.labels++
+			id := g.labels
+			g.aluImm(aluCmp, g.size, g.cell(0), 0)
+			g.jump(ccE, fmt.Sprintf("close_loop_%d", id))
+			g.label(fmt.Sprintf("label_loop_%d", id))
+
+			g.generateInstructions(ins.Body)
+
+			g.aluImm(aluCmp, g.size, g.cell(0), 0)
+			g.jump(ccNE, fmt.Sprintf("label_loop_%d", id))
+			g.label(fmt.Sprintf("close_loop_%d", id))
+		}
+	}
+}
+
+// cell is the equivalent of GeneratorASM.cell.
+func (g *GeneratorELF) cell(offset int) elfOperand {
+	return elfMem(r8, offset*g.size/8)
+}
+
+// access is the equivalent of GeneratorASM.access.
+func (g *GeneratorELF) access(ins *ir.Instruction, offset int) elfOperand {
+	switch g.mode {
+	case TapeCheck:
+		g.checkBounds(ins, offset)
+	case TapeWrap:
+		if offset != 0 {
+			g.wrap(rcx, offset*g.size/8, offset*g.size/8)
+			return elfMem(rcx, 0)
+		}
+	}
+	return g.cell(offset)
+}
+
+// moved is the equivalent of GeneratorASM.moved.
+func (g *GeneratorELF) moved(ins *ir.Instruction, bytes int) {
+	switch g.mode {
+	case TapeCheck:
+		g.checkBounds(ins, 0)
+	case TapeWrap:
+		g.wrap(r8, 0, bytes)
+	}
+}
+
+// checkBounds is the equivalent of GeneratorASM.checkBounds.
+func (g *GeneratorELF) checkBounds(ins *ir.Instruction, offset int) {
+
+	g.bounds = append(g.bounds, ins)
+	id := len(g.bounds)
+
+	g.lea(rax, elfMem(r8, offset*g.size/8))
+	g.movLabel(rdx, "stack")
+	g.alu(aluSub, 64, elfReg(rax), rdx)
+	g.movImm(rdx, g.options.TapeSize*g.size/8)
+	g.alu(aluCmp, 64, elfReg(rax), rdx)
+	g.jump(ccAE, fmt.Sprintf("bounds_%d", id))
+}
+
+// wrap is the equivalent of GeneratorASM.wrap.
+func (g *GeneratorELF) wrap(reg int, offset int, distance int) {
+
+	size := g.options.TapeSize * g.size / 8
+
+	if reg != r8 || offset != 0 {
+		g.lea(reg, elfMem(r8, offset))
+	}
+	g.movLabel(rdx, "stack")
+	g.alu(aluSub, 64, elfReg(reg), rdx)
+
+	if distance <= -size || distance >= size {
+		g.store(64, elfReg(rax), reg)
+		g.code.Write([]byte{0x48, 0x99}) // cqo
+		g.movImm(rsi, size)
+		g.emit(64, []byte{0xF7}, 7, elfReg(rsi)) // idiv rsi
+		g.store(64, elfReg(reg), rdx)
+		g.movLabel(rdx, "stack")
+	}
+	g.lea(rax, elfMem(reg, size))
+	g.test(reg)
+	g.cmov(ccS, reg, rax)
+	g.lea(rax, elfMem(reg, -size))
+	g.aluImm(aluCmp, 64, elfReg(reg), size)
+	g.cmov(ccGE, reg, rax)
+	g.alu(aluAdd, 64, elfReg(reg), rdx)
+}
+
+// arith is the equivalent of GeneratorASM.arith.
+func (g *GeneratorELF) arith(op int, cell elfOperand, value int) {
+
+	if g.size < 64 {
+		value &= (1 << uint(g.size)) - 1
+	}
+
+	if g.size == 64 && (value > math.MaxInt32 || value < math.MinInt32) {
+		g.movImm(rax, value)
+		if op == aluMov {
+			g.store(64, cell, rax)
+		} else {
+			g.alu(op, 64, cell, rax)
+		}
+		return
+	}
+
+	if op == aluMov {
+		g.movImmMem(g.size, cell, value)
+	} else {
+		g.aluImm(op, g.size, cell, value)
+	}
+}
+
+//
+// Everything below here encodes individual instructions.
+//
+
+// emit writes an instruction with the given opcode, operating upon
+// values of the given size, in bits.
+//
+// The reg value is either a register, or an extension of the opcode,
+// and rm is the operand which may refer to memory.  Any immediate value
+// must be written by the caller afterwards.
+func (g *GeneratorELF) emit(size int, opcode []byte, reg int, rm elfOperand) {
+
+	if size == 16 {
+		g.code.WriteByte(0x66)
+	}
+
+	rex := byte(0x40)
+	if size == 64 {
+		rex |= 0x08
+	}
+	if reg&8 != 0 {
+		rex |= 0x04
+	}
+	if rm.direct && rm.reg&8 != 0 {
+		rex |= 0x01
+	}
+	if !rm.direct && rm.index > 0 && rm.index&8 != 0 {
+		rex |= 0x02
+	}
+	if !rm.direct && rm.base > 0 && rm.base&8 != 0 {
+		rex |= 0x01
+	}
+	if rex != 0x40 {
+		g.code.WriteByte(rex)
+	}
+	g.code.Write(opcode)
+
+	reg = (reg & 7) << 3
+
+	switch {
+	case rm.direct:
+		g.code.WriteByte(byte(0xC0 | reg | rm.reg&7))
+
+	case rm.label != "":
+		// An absolute address, with no base or index.
+		g.code.WriteByte(byte(reg | 0x04))
+		g.code.WriteByte(0x25)
+		g.fixup(rm.label, false)
+
+	default:
+		mod := 0x80
+		if rm.disp == 0 && rm.base&7 != 5 {
+			mod = 0x00
+		} else if rm.disp >= math.MinInt8 && rm.disp <= math.MaxInt8 {
+			mod = 0x40
+		}
+
+		if rm.index >= 0 || rm.base&7 == 4 {
+			index := 4
+			if rm.index >= 0 {
+				index = rm.index & 7
+			}
+			g.code.WriteByte(byte(mod | reg | 0x04))
+			g.code.WriteByte(byte(index<<3 | rm.base&7))
+		} else {
+			g.code.WriteByte(byte(mod | reg | rm.base&7))
+		}
+
+		switch mod {
+		case 0x40:
+			g.imm(1, rm.disp)
+		case 0x80:
+			g.imm(4, rm.disp)
+		}
+	}
+}
+
+// imm writes a little-endian value of the given number of bytes,
+// truncating it if necessary.
+func (g *GeneratorELF) imm(n int, value int) {
+	for i := 0; i < n; i++ {
+		g.code.WriteByte(byte(value >> uint(8*i)))
+	}
+}
+
+// label records that the given label refers to the current position in
+// our code.
+func (g *GeneratorELF) label(name string) {
+	g.text[name] = g.code.Len()
+}
+
+// fixup writes a placeholder for a reference to the given label.
+func (g *GeneratorELF) fixup(label string, relative bool) {
+	g.fixups = append(g.fixups, elfFixup{pos: g.code.Len(), label: label, relative: relative})
+	g.imm(4, 0)
+}
+
+// jump writes a jump to the given label, if the condition is true.  A
+// condition of -1 jumps unconditionally.
+//
+// Jumps backwards use the shortest encoding possible, but as we don't
+// know how far away the labels we jump forward to are we always use the
+// longest for those.
+func (g *GeneratorELF) jump(cc int, label string) {
+
+	if pos, ok := g.text[label]; ok {
+		rel := pos - (g.code.Len() + 2)
+		if rel >= math.MinInt8 {
+			if cc < 0 {
+				g.code.WriteByte(0xEB)
+			} else {
+				g.code.WriteByte(byte(0x70 + cc))
+			}
+			g.imm(1, rel)
+			return
+		}
+	}
+
+	if cc < 0 {
+		g.code.WriteByte(0xE9)
+	} else {
+		g.code.Write([]byte{0x0F, byte(0x80 + cc)})
+	}
+	g.fixup(label, true)
+}
+
+// call writes a call to the given label.
+func (g *GeneratorELF) call(label string) {
+	g.code.WriteByte(0xE8)
+	g.fixup(label, true)
+}
+
+// ret writes a return from a call.
+func (g *GeneratorELF) ret() {
+	g.code.WriteByte(0xC3)
+}
+
+// syscall writes a system-call.
+func (g *GeneratorELF) syscall() {
+	g.code.Write([]byte{0x0F, 0x05})
+}
+
+// push writes an instruction which pushes the given register.
+func (g *GeneratorELF) push(reg int) {
+	g.code.WriteByte(byte(0x50 + reg))
+}
+
+// pop writes an instruction which pops the given register.
+func (g *GeneratorELF) pop(reg int) {
+	g.code.WriteByte(byte(0x58 + reg))
+}
+
+// movImm writes an instruction which stores a constant in a register.
+func (g *GeneratorELF) movImm(reg int, value int) {
+
+	switch {
+	case value >= 0 && int64(value) <= math.MaxUint32:
+		// Writing the 32-bit register clears the upper half.
+		if reg&8 != 0 {
+			g.code.WriteByte(0x41)
+		}
+		g.code.WriteByte(byte(0xB8 + reg&7))
+		g.imm(4, value)
+	case value >= math.MinInt32:
+		g.emit(64, []byte{0xC7}, 0, elfReg(reg))
+		g.imm(4, value)
+	default:
+		g.code.WriteByte(byte(0x48 | (reg&8)>>3))
+		g.code.WriteByte(byte(0xB8 + reg&7))
+		g.imm(8, value)
+	}
+}
+
+// movLabel writes an instruction which stores the address of the given
+// label in a register.
+func (g *GeneratorELF) movLabel(reg int, label string) {
+	if reg&8 != 0 {
+		g.code.WriteByte(0x41)
+	}
+	g.code.WriteByte(byte(0xB8 + reg&7))
+	g.fixup(label, false)
+}
+
+// movImmMem writes an instruction which stores a constant in the given
+// operand, truncated to the given size.
+//
+// 64-bit values are sign-extended from 32-bits.
+func (g *GeneratorELF) movImmMem(size int, rm elfOperand, value int) {
+	switch size {
+	case 8:
+		g.emit(size, []byte{0xC6}, 0, rm)
+		g.imm(1, value)
+	case 16:
+		g.emit(size, []byte{0xC7}, 0, rm)
+		g.imm(2, value)
+	default:
+		g.emit(size, []byte{0xC7}, 0, rm)
+		g.imm(4, value)
+	}
+}
+
+// load writes an instruction which loads the given operand into a
+// register.
+func (g *GeneratorELF) load(size int, reg int, rm elfOperand) {
+	if size == 8 {
+		g.emit(size, []byte{0x8A}, reg, rm)
+	} else {
+		g.emit(size, []byte{0x8B}, reg, rm)
+	}
+}
+
+// store writes an instruction which stores a register in the given
+// operand.
+func (g *GeneratorELF) store(size int, rm elfOperand, reg int) {
+	if size == 8 {
+		g.emit(size, []byte{0x88}, reg, rm)
+	} else {
+		g.emit(size, []byte{0x89}, reg, rm)
+	}
+}
+
+// movzx writes an instruction which loads an 8, or 16-bit, operand into
+// a register, zero-extending it.
+func (g *GeneratorELF) movzx(size int, reg int, rm elfOperand) {
+	if size == 8 {
+		g.emit(32, []byte{0x0F, 0xB6}, reg, rm)
+	} else {
+		g.emit(32, []byte{0x0F, 0xB7}, reg, rm)
+	}
+}
+
+// lea writes an instruction which stores the address of the given
+// operand in a register.
+func (g *GeneratorELF) lea(reg int, rm elfOperand) {
+	g.emit(64, []byte{0x8D}, reg, rm)
+}
+
+// alu writes an instruction which applies the given operation to the
+// operand, and a register, storing the result in the operand.
+func (g *GeneratorELF) alu(op int, size int, rm elfOperand, reg int) {
+	if size == 8 {
+		g.emit(size, []byte{byte(op * 8)}, reg, rm)
+	} else {
+		g.emit(size, []byte{byte(op*8 + 1)}, reg, rm)
+	}
+}
+
+// aluImm writes an instruction which applies the given operation to the
+// operand, and a constant.
+//
+// 64-bit values are sign-extended from 32-bits.
+func (g *GeneratorELF) aluImm(op int, size int, rm elfOperand, value int) {
+	switch {
+	case size == 8:
+		g.emit(size, []byte{0x80}, op, rm)
+		g.imm(1, value)
+	case value >= math.MinInt8 && value <= math.MaxInt8:
+		g.emit(size, []byte{0x83}, op, rm)
+		g.imm(1, value)
+	case size == 16:
+		g.emit(size, []byte{0x81}, op, rm)
+		g.imm(2, value)
+	default:
+		g.emit(size, []byte{0x81}, op, rm)
+		g.imm(4, value)
+	}
+}
+
+// inc writes an instruction which increments a register.
+func (g *GeneratorELF) inc(reg int) {
+	g.emit(64, []byte{0xFF}, 0, elfReg(reg))
+}
+
+// test writes an instruction which compares a register with zero.
+func (g *GeneratorELF) test(reg int) {
+	g.emit(64, []byte{0x85}, reg, elfReg(reg))
+}
+
+// cmov writes an instruction which copies the register src to dst, if
+// the condition is true.
+func (g *GeneratorELF) cmov(cc int, dst int, src int) {
+	g.emit(64, []byte{0x0F, byte(0x40 + cc)}, dst, elfReg(src))
+}
+
+// imul writes an instruction which multiplies a register by a constant.
+//
+// Only the low bits of the result matter, so unless our cells are 64-bit
+// we use the 32-bit form, as the asm backend does.
+func (g *GeneratorELF) imul(reg int, value int) {
+
+	size := 32
+	if g.size == 64 {
+		size = 64
+	}
+
+	if value >= math.MinInt8 && value <= math.MaxInt8 {
+		g.emit(size, []byte{0x6B}, reg, elfReg(reg))
+		g.imm(1, value)
+	} else {
+		g.emit(size, []byte{0x69}, reg, elfReg(reg))
+		g.imm(4, value)
+	}
+}
+
+// link places our code, and our variables, in memory, and returns the
+// executable which contains them.
+func (g *GeneratorELF) link() ([]byte, error) {
+
+	text := elfBase + elfHeaders
+	size := elfHeaders + g.code.Len()
+
+	//
+	// Our variables, and the tape, follow our code in memory,
+	// starting on a fresh page.
+	//
+	bss := (elfBase + size + elfPage - 1) &^ (elfPage - 1)
+	memsz := int64(elfBSS["stack"]) + int64(g.options.TapeSize)*int64(g.size/8)
+
+	//
+	// Every address must fit in 32-bits, as must the size of the
+	// tape, which we use as an offset when wrapping.
+	//
+	// We use 64-bit arithmetic for this, so that a large tape
+	// cannot overflow when we're built for a 32-bit system.
+	//
+	if int64(bss)+memsz > math.MaxInt32 {
+		return nil, &UnsupportedError{Backend: "elf", Feature: "a tape of this size"}
+	}
+
+	//
+	// Now we know where everything is we can update the references
+	// to our labels.
+	//
+	code := g.code.Bytes()
+	for _, fix := range g.fixups {
+		var addr int
+		if pos, ok := g.text[fix.label]; ok {
+			addr = text + pos
+		} else if off, ok := elfBSS[fix.label]; ok {
+			addr = bss + off
+		} else {
+			return nil, fmt.Errorf("reference to unknown label %s", fix.label)
+		}
+
+		if fix.relative {
+			addr -= text + fix.pos + 4
+		}
+		binary.LittleEndian.PutUint32(code[fix.pos:], uint32(addr))
+	}
+
+	//
+	// The ELF header, and the program-headers describing our two
+	// segments, come before our code.
+	//
+	header := elf.Header64{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Entry:     uint64(text + g.text["_start"]),
+		Phoff:     64,
+		Ehsize:    64,
+		Phentsize: 56,
+		Phnum:     2,
+		Shentsize: 64,
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	segments := []elf.Prog64{
+		{
+			Type:   uint32(elf.PT_LOAD),
+			Flags:  uint32(elf.PF_R | elf.PF_X),
+			Vaddr:  elfBase,
+			Paddr:  elfBase,
+			Filesz: uint64(size),
+			Memsz:  uint64(size),
+			Align:  elfPage,
+		},
+		{
+			Type:  uint32(elf.PT_LOAD),
+			Flags: uint32(elf.PF_R | elf.PF_W),
+			Vaddr: uint64(bss),
+			Paddr: uint64(bss),
+			Memsz: uint64(memsz),
+			Align: elfPage,
+		},
+	}
+
+	var buff bytes.Buffer
+	binary.Write(&buff, binary.LittleEndian, header)
+	binary.Write(&buff, binary.LittleEndian, segments)
+	buff.Write(code)
+
+	return buff.Bytes(), nil
+}
+
+// Generate takes the specified input-string and writes it as a compiled
+// binary to the named output-path.
+//
+// We generate the machine-code ourselves, so no other tools are used.
+func (g *GeneratorELF) Generate(input string, output string, options Options) error {
+
+	//
+	// Save the input and output path away, along with our options.
+	//
+	g.input = input
+	g.output = output
+	g.options = options
+
+	err := options.Validate()
+	if err != nil {
+		return err
+	}
+
+	//
+	// Generate our program
+	//
+	err = g.program()
+	if err != nil {
+		return err
+	}
+
+	//
+	// Place it in an executable
+	//
+	exe, err := g.link()
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(g.output, exe, 0755)
+}
+
+// Register our back-end
+func init() {
+	Register("elf", func() Generator {
+		return &GeneratorELF{}
+	})
+}
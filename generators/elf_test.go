@@ -0,0 +1,61 @@
+package generators
+
+import (
+	"debug/elf"
+	"io/ioutil"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// TestELF compiles our examples, and ensures the resulting executables
+// produce the output expected.
+func TestELF(t *testing.T) {
+
+	output := tempOutput(t)
+
+	for _, name := range []string{"hello-world", "fibonacci", "bizzfuzz", "quine", "factor"} {
+
+		src, err := ioutil.ReadFile("../examples/" + name + ".bf")
+		if err != nil {
+			t.Fatalf("failed to read example %s: %s", name, err)
+		}
+		expected, err := ioutil.ReadFile("../examples/" + name + ".out")
+		if err != nil {
+			t.Fatalf("failed to read expected output for %s: %s", name, err)
+		}
+
+		err = GetGenerator("elf").Generate(string(src), output, DefaultOptions())
+		if err != nil {
+			t.Fatalf("error compiling %s: %s", name, err)
+		}
+
+		// Ensure we've written something sensible.
+		exe, err := elf.Open(output)
+		if err != nil {
+			t.Fatalf("%s: failed to parse the executable: %s", name, err)
+		}
+		exe.Close()
+		if exe.Type != elf.ET_EXEC || exe.Machine != elf.EM_X86_64 {
+			t.Fatalf("%s: wrong type of executable %s %s", name, exe.Type, exe.Machine)
+		}
+
+		// Running it requires the right kind of system.
+		if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+			continue
+		}
+
+		cmd := exec.Command(output)
+		input, _ := ioutil.ReadFile("../examples/" + name + ".in")
+		cmd.Stdin = strings.NewReader(string(input))
+
+		got, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("error running %s: %s", name, err)
+		}
+		if string(got) != string(expected) {
+			t.Fatalf("wrong output for %s, got %q", name, got)
+		}
+	}
+}
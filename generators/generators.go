@@ -5,15 +5,208 @@
 // which is used, by name, at runtime.
 package generators
 
-import "sync"
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+
+	"github.com/skx/bfcc/ir"
+	"github.com/skx/bfcc/lexer"
+)
 
 // Generator is the interface which must be implemented by
 // a backend to compile our code
 type Generator interface {
 
 	// Generate an executable at the path "output", from the
-	// brainfuck source-code stored in "input".
-	Generate(input string, output string) error
+	// brainfuck source-code stored in "input", configured by
+	// the given options.
+	Generate(input string, output string, options Options) error
+}
+
+// SourceGenerator is implemented by backends which work by generating
+// source-code, which is then compiled.
+//
+// It allows that source to be retrieved without compiling it, so no
+// external tools are required.
+type SourceGenerator interface {
+
+	// Source returns the source-code which would be compiled to
+	// produce an executable from the brainfuck source-code stored
+	// in "input", configured by the given options.
+	Source(input string, options Options) (string, error)
+}
+
+// KeptSourceGenerator is implemented by backends which compile
+// source-code written to a temporary file.
+//
+// That file is normally removed once compilation has finished, but if
+// the options disable cleanup it is kept, and its path is returned by
+// KeptSource after Generate has been called.
+type KeptSourceGenerator interface {
+
+	// KeptSource returns the path of the source-file we kept
+	// when we last generated an executable, or "" if it was
+	// removed.
+	KeptSource() string
+}
+
+// parse converts the given brainfuck source-code into our intermediate
+// representation, and applies the optimizations enabled at the given
+// level to it.
+//
+// This is shared by all our backends.  If the program is not valid then
+// an *ir.ValidationError is returned.
+func parse(input string, level int) ([]*ir.Instruction, error) {
+
+	// Create a lexer for the input program
+	l := lexer.New(input)
+
+	// Convert the tokens to our intermediate form
+	program, err := ir.Parse(l.Tokens())
+	if err != nil {
+		return nil, err
+	}
+
+	return ir.Optimize(program, level), nil
+}
+
+// writeSource writes the generated source-code of a program to a file
+// with the given name, and returns its path.
+//
+// The file is created within a new private temporary directory, so
+// concurrent builds cannot interfere with each other.
+func writeSource(src string, name string) (string, error) {
+
+	dir, err := ioutil.TempDir("", "bfcc")
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, name)
+	err = ioutil.WriteFile(path, []byte(src), 0644)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return path, nil
+}
+
+// removeSource removes the directory created by writeSource, if the
+// options say we should cleanup.  Otherwise the path of the source-file
+// is returned, so that it can be shown to the user.
+func removeSource(path string, options Options) string {
+	if !options.Cleanup {
+		return path
+	}
+	os.RemoveAll(filepath.Dir(path))
+	return ""
+}
+
+// These constants describe what happens to the current cell when
+// input is requested, but none is available.
+const (
+	// EOFZero stores zero in the cell.
+	EOFZero = "zero"
+
+	// EOFMinusOne stores -1 in the cell, truncated to the cell-width.
+	EOFMinusOne = "minus-one"
+
+	// EOFUnchanged leaves the cell alone.
+	EOFUnchanged = "unchanged"
+)
+
+// These constants describe what happens when the memory-pointer moves
+// past either end of the tape.
+const (
+	// TapeFixed performs no checks, so moving outside the tape has
+	// undefined results.
+	TapeFixed = "fixed"
+
+	// TapeCheck terminates the program with an error.
+	TapeCheck = "check"
+
+	// TapeWrap wraps the pointer around to the other end of the tape.
+	TapeWrap = "wrap"
+
+	// TapeGrow makes the tape larger whenever the pointer moves past
+	// the right-hand end of it.  Moving past the left-hand end is
+	// treated as an error, as with TapeCheck.
+	//
+	// Not every backend supports this.
+	TapeGrow = "grow"
+)
+
+// UnsupportedError is returned by a backend if it is asked to generate
+// a program using a feature which it doesn't support.
+type UnsupportedError struct {
+
+	// Backend contains the name of the backend.
+	Backend string
+
+	// Feature describes what was requested.
+	Feature string
+}
+
+// Error implements the error interface.
+func (u *UnsupportedError) Error() string {
+	return fmt.Sprintf("the %s backend does not support %s", u.Backend, u.Feature)
+}
+
+// ToolError is returned by a backend if an external program which it
+// needs, such as the compiler, cannot be found.
+type ToolError struct {
+
+	// Tool contains the name of the program.
+	Tool string
+}
+
+// Error implements the error interface.
+func (t *ToolError) Error() string {
+	return fmt.Sprintf("%s was not found in your PATH", t.Tool)
+}
+
+// command returns a command which will run the named external program,
+// with its output shown to the user.
+//
+// If the program isn't installed a *ToolError is returned.
+func command(name string, args ...string) (*exec.Cmd, error) {
+
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return nil, &ToolError{Tool: name}
+	}
+
+	cmd := exec.Command(path, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd, nil
+}
+
+// BoundsExitCode is the exit-code used when a program with bounds-checking
+// enabled accesses memory outside the tape.
+const BoundsExitCode = 3
+
+// BoundsError is returned by the interpreter, when bounds-checking is
+// enabled, if the program accesses memory outside the tape.
+//
+// Compiled programs print the same message and terminate with
+// BoundsExitCode.
+type BoundsError struct {
+
+	// Line contains the line-number of the instruction which failed.
+	Line int
+
+	// Column contains the column of the instruction which failed.
+	Column int
+}
+
+// Error implements the error interface.
+func (b *BoundsError) Error() string {
+	return fmt.Sprintf("pointer out of bounds at line %d, column %d", b.Line, b.Column)
 }
 
 //
@@ -0,0 +1,384 @@
+package generators
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skx/bfcc/ir"
+)
+
+// tempOutput returns the path of an executable for a test to generate,
+// within a temporary directory which is removed once the test finishes.
+func tempOutput(t *testing.T) string {
+
+	dir, err := ioutil.TempDir("", "bfcc")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return filepath.Join(dir, "a.out")
+}
+
+// optionTests are programs whose output depends upon the options they
+// are run with, which every backend should respect.
+var optionTests = []struct {
+	program  string
+	input    string
+	options  func(o *Options)
+	expected string
+}{
+	{",[.,]", "Hello, World", func(o *Options) { o.EOF = EOFZero }, "Hello, World"},
+	{",+.,+.", "ab", func(o *Options) {}, "bc"},
+	{",.,.,.", "ab", func(o *Options) { o.EOF = EOFMinusOne }, "ab\xff"},
+	{",.,.,.", "ab", func(o *Options) { o.EOF = EOFUnchanged }, "abb"},
+	{"-[>+>+<<-]>.>[-]+[-<+>]<.", "", func(o *Options) { o.CellSize = 16 }, "\xff\x00"},
+	{"-.", "", func(o *Options) { o.TapeSize = 1; o.CellSize = 32; o.Tape = TapeCheck }, "\xff"},
+	{"-[>+<-]>.", "", func(o *Options) { o.CellSize = 64 }, "\xff"},
+	{"<++++++++[>++++++++<-]>+.", "", func(o *Options) { o.TapeSize = 4; o.Tape = TapeWrap }, "A"},
+	{"+++[>++++++++++<-]>+++.", "", func(o *Options) { o.Optimization = 0 }, "!"},
+}
+
+// execute runs the given program with the named backend, and returns
+// the output it wrote to STDOUT and STDERR.
+//
+// The interpreter runs the program itself, the other backends generate
+// an executable which is then run.  If that isn't possible on this
+// system the test is skipped.
+func execute(t *testing.T, name string, program string, input string, options Options) (string, string, error) {
+
+	var stdout, stderr bytes.Buffer
+
+	if name == "interpreter" {
+		err := NewInterpreter(strings.NewReader(input), &stdout, WithOptions(options)).Run(program)
+		if err != nil {
+			stderr.WriteString(err.Error() + "\n")
+		}
+		return stdout.String(), stderr.String(), err
+	}
+
+	cmd := exec.Command(compile(t, name, program, options))
+	cmd.Stdin = strings.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	return stdout.String(), stderr.String(), err
+}
+
+// compile generates an executable from the given program with the named
+// backend, and returns its path.  If the executable cannot be run on this
+// system the test is skipped.
+func compile(t *testing.T, name string, program string, options Options) string {
+
+	if name != "c" && (runtime.GOOS != "linux" || runtime.GOARCH != "amd64") {
+		t.Skip("cannot run linux/amd64 executables")
+	}
+	if name != "elf" {
+		if _, err := exec.LookPath("gcc"); err != nil {
+			t.Skip("gcc is not installed")
+		}
+	}
+
+	output := tempOutput(t)
+	err := GetGenerator(name).Generate(program, output, options)
+	if err != nil {
+		t.Fatalf("error compiling %s: %s", program, err)
+	}
+	return output
+}
+
+// prompt is a reader which records the output a program has written when
+// it first asks for input, and then reports end-of-file.
+type prompt struct {
+	out  *bytes.Buffer
+	seen *string
+}
+
+// Read implements the io.Reader interface.
+func (p prompt) Read(buf []byte) (int, error) {
+	if *p.seen == "" {
+		*p.seen = p.out.String()
+	}
+	return 0, io.EOF
+}
+
+// TestFlush ensures that every backend writes any pending output before
+// it waits for input, so that a prompt is seen before it is answered.
+func TestFlush(t *testing.T) {
+
+	for _, name := range Available() {
+		t.Run(name, func(t *testing.T) {
+
+			if name == "interpreter" {
+				var out bytes.Buffer
+				var seen string
+
+				err := NewInterpreter(prompt{out: &out, seen: &seen}, &out).Run("+++.,")
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if seen != "\x03" {
+					t.Fatalf("output was not written before reading input, got %q", seen)
+				}
+				return
+			}
+
+			cmd := exec.Command(compile(t, name, "+++.,", DefaultOptions()))
+			stdin, err := cmd.StdinPipe()
+			if err != nil {
+				t.Fatalf("failed to create pipe: %s", err)
+			}
+			stdout, err := cmd.StdoutPipe()
+			if err != nil {
+				t.Fatalf("failed to create pipe: %s", err)
+			}
+			err = cmd.Start()
+			if err != nil {
+				t.Fatalf("error running program: %s", err)
+			}
+			defer cmd.Wait()
+			defer stdin.Close()
+
+			// The output must arrive while the program is
+			// still waiting for its input.
+			got := make(chan []byte, 1)
+			go func() {
+				buf := make([]byte, 1)
+				n, _ := io.ReadFull(stdout, buf)
+				got <- buf[:n]
+			}()
+
+			select {
+			case out := <-got:
+				if string(out) != "\x03" {
+					t.Fatalf("wrong output %q", out)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("output was not written before reading input")
+			}
+		})
+	}
+}
+
+// TestOptions ensures that every backend respects the options it is
+// given.
+func TestOptions(t *testing.T) {
+
+	for _, name := range Available() {
+		t.Run(name, func(t *testing.T) {
+
+			for _, test := range optionTests {
+				options := DefaultOptions()
+				test.options(&options)
+
+				got, _, err := execute(t, name, test.program, test.input, options)
+				if err != nil {
+					t.Fatalf("error running %s: %s", test.program, err)
+				}
+				if got != test.expected {
+					t.Fatalf("wrong output for %s, expected %q got %q", test.program, test.expected, got)
+				}
+			}
+
+			// Out of bounds accesses are reported, once any
+			// earlier output has been written, against the
+			// instruction which made them.
+			bounds := []struct {
+				program  string
+				expected string
+				message  string
+			}{
+				{"+++.\n  <+", "\x03", "pointer out of bounds at line 2, column 4\n"},
+				{">>>>>>>>\n.", "", "pointer out of bounds at line 1, column 1\n"},
+			}
+			for _, test := range bounds {
+				options := DefaultOptions()
+				options.Tape = TapeCheck
+				options.TapeSize = 4
+
+				got, stderr, err := execute(t, name, test.program, "", options)
+				if err == nil {
+					t.Fatalf("%s: expected an error", test.program)
+				}
+				if exit, ok := err.(*exec.ExitError); ok && exit.ExitCode() != BoundsExitCode {
+					t.Fatalf("%s: expected exit-code %d, got %d", test.program, BoundsExitCode, exit.ExitCode())
+				}
+				if got != test.expected || stderr != test.message {
+					t.Fatalf("%s: wrong output %q %q", test.program, got, stderr)
+				}
+			}
+		})
+	}
+}
+
+// TestErrors ensures that our backends return errors, rather than
+// terminating, when given something they cannot handle.
+func TestErrors(t *testing.T) {
+
+	output := tempOutput(t)
+
+	for _, name := range Available() {
+
+		// An invalid program.
+		err := GetGenerator(name).Generate("+[[]", output, DefaultOptions())
+		if _, ok := err.(*ir.ValidationError); !ok {
+			t.Fatalf("%s: expected a validation error, got %v", name, err)
+		}
+
+		// Invalid options.
+		options := DefaultOptions()
+		options.CellSize = 12
+		err = GetGenerator(name).Generate("+", output, options)
+		if err == nil {
+			t.Fatalf("%s: expected an error from invalid options", name)
+		}
+	}
+
+	// The asm and elf backends cannot grow their tape.
+	options := DefaultOptions()
+	options.Tape = TapeGrow
+	for _, name := range []string{"asm", "elf"} {
+		err := GetGenerator(name).Generate("+", output, options)
+		if _, ok := err.(*UnsupportedError); !ok {
+			t.Fatalf("%s: expected an unsupported error, got %v", name, err)
+		}
+	}
+
+	// A compiler which isn't installed.
+	for _, name := range []string{"asm", "c"} {
+		options = DefaultOptions()
+		options.Compiler = "bfcc-no-such-compiler gcc"
+		err := GetGenerator(name).Generate("+", output, options)
+		tool, ok := err.(*ToolError)
+		if !ok {
+			t.Fatalf("%s: expected a tool error, got %v", name, err)
+		}
+		if tool.Tool != "bfcc-no-such-compiler" {
+			t.Fatalf("%s: wrong tool %s", name, tool.Tool)
+		}
+	}
+}
+
+// TestCompiler ensures the compiler may be given along with arguments
+// of its own, as is common with $CC.
+func TestCompiler(t *testing.T) {
+
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc is not installed")
+	}
+
+	output := tempOutput(t)
+
+	for _, name := range []string{"asm", "c"} {
+		options := DefaultOptions()
+		options.Compiler = "gcc -w"
+		err := GetGenerator(name).Generate("+.", output, options)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", name, err)
+		}
+	}
+}
+
+// TestSource ensures the source-code of compiled backends can be
+// retrieved without compiling it.
+func TestSource(t *testing.T) {
+
+	for name, expected := range map[string]string{"asm": "_start:", "c": "int main"} {
+		gen, ok := GetGenerator(name).(SourceGenerator)
+		if !ok {
+			t.Fatalf("%s: expected to be able to generate source", name)
+		}
+
+		src, err := gen.Source("+[-].", DefaultOptions())
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", name, err)
+		}
+		if !strings.Contains(src, expected) {
+			t.Fatalf("%s: expected %q in source, got %s", name, expected, src)
+		}
+
+		_, err = gen.Source("+[", DefaultOptions())
+		if _, ok = err.(*ir.ValidationError); !ok {
+			t.Fatalf("%s: expected a validation error, got %v", name, err)
+		}
+	}
+
+	if _, ok := GetGenerator("interpreter").(SourceGenerator); ok {
+		t.Fatalf("the interpreter has no source to generate")
+	}
+}
+
+// TestCleanup ensures that the compiling backends remove their
+// intermediate files, even when compilation fails.
+func TestCleanup(t *testing.T) {
+
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc is not installed")
+	}
+
+	output := tempOutput(t)
+	dir := filepath.Dir(output)
+
+	// Our temporary files will be created beneath this directory.
+	tmp := filepath.Join(dir, "tmp")
+	err := os.Mkdir(tmp, 0755)
+	if err != nil {
+		t.Fatalf("failed to create directory: %s", err)
+	}
+	orig := os.Getenv("TMPDIR")
+	os.Setenv("TMPDIR", tmp)
+	defer os.Setenv("TMPDIR", orig)
+
+	for _, name := range []string{"asm", "c"} {
+
+		err = GetGenerator(name).Generate("+.", output, DefaultOptions())
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", name, err)
+		}
+
+		options := DefaultOptions()
+		options.CFlags = []string{"-bfcc-invalid-flag"}
+		stderr := os.Stderr
+		os.Stderr, _ = os.Open(os.DevNull)
+		err = GetGenerator(name).Generate("+.", output, options)
+		os.Stderr.Close()
+		os.Stderr = stderr
+		if err == nil {
+			t.Fatalf("%s: expected an error from an invalid flag", name)
+		}
+
+		// The source is kept, if we ask.
+		options = DefaultOptions()
+		options.Cleanup = false
+		gen := GetGenerator(name)
+		err = gen.Generate("+.", output, options)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", name, err)
+		}
+		kept := gen.(KeptSourceGenerator).KeptSource()
+		if _, err = os.Stat(kept); err != nil {
+			t.Fatalf("%s: the source was not kept: %s", name, err)
+		}
+		os.RemoveAll(filepath.Dir(kept))
+
+		for _, path := range []string{dir, tmp} {
+			files, err := ioutil.ReadDir(path)
+			if err != nil {
+				t.Fatalf("failed to read %s: %s", path, err)
+			}
+			for _, file := range files {
+				if file.Name() != "a.out" && file.Name() != "tmp" {
+					t.Fatalf("%s: %s was left behind", name, file.Name())
+				}
+			}
+		}
+	}
+}
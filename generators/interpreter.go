@@ -1,10 +1,13 @@
 package generators
 
 import (
+	"bufio"
+	"context"
 	"fmt"
+	"io"
 	"os"
 
-	"github.com/skx/bfcc/lexer"
+	"github.com/skx/bfcc/ir"
 )
 
 // Interpreter is a generator which will actually interpret, or execute,
@@ -14,20 +17,44 @@ import (
 // As our host application is designed to be a compiler this is a little
 // atypical, however it demonstrates the speedup possible by compilation.
 //
-// In my rough tests this interpreter is 200 times slower executing our
-// mandelbrot example.
+// The matching bracket of every loop is resolved once, when the program
+// is loaded, so jumping to the start or end of a loop is a single step.
+//
+// When registered as a backend the interpreter uses STDIN and STDOUT.
+// To embed it in another application use NewInterpreter instead.
 type Interpreter struct {
 
+	//
+	// Our configuration
+	//
+
+	// reader is the source of the program's input.
+	reader io.Reader
+
+	// writer is the destination of the program's output.
+	writer io.Writer
+
+	// options holds our settings.  Those which only matter when
+	// writing files, such as Cleanup, are ignored.
+	options Options
+
+	// limit is the maximum number of instructions a program may
+	// execute, or zero if there is no limit.
+	limit int
+
 	//
 	// Our state
 	//
 
-	// The lexed tokens of our input program.
-	tokens []*lexer.Token
+	// The flattened instructions of our input program.
+	code []op
 
 	// The offset within the program which we're executing.
 	offset int
 
+	// steps is the number of instructions we've executed.
+	steps int
+
 	//
 	// BF virtual machine
 	//
@@ -36,37 +63,305 @@ type Interpreter struct {
 	ptr int
 
 	// The memory.
-	memory [3000]int
+	memory []uint64
+
+	// in buffers the input of the program.
+	in *bufio.Reader
+
+	// out buffers the output of the program.
+	//
+	// It is flushed when full, before we wait for more input, and
+	// when the program terminates.
+	out *bufio.Writer
+
+	// mask is applied to the contents of cells after they're
+	// modified, to truncate them to the selected cell-width.
+	mask uint64
+
+	// edges is true if the tape wraps or grows, so the position of
+	// each cell we access must be adjusted rather than just checked.
+	edges bool
+}
+
+// scanBatch is the largest number of cells a search, such as "[>]", will
+// pass in a single step.
+const scanBatch = 1024
+
+// op is a single instruction of our flattened program.
+//
+// Loops are flattened into a pair of opLoopOpen and opLoopClose
+// instructions, each of which records the offset of the other.
+type op struct {
+
+	// kind holds the instruction-type.
+	kind opcode
+
+	// value holds the argument of the instruction.
+	value int
+
+	// offset holds the position of the target cell, relative to
+	// the memory-pointer.
+	offset int
+
+	// target holds the offset of the matching instruction, for
+	// opLoopOpen and opLoopClose.
+	target int
+
+	// line and column hold the source-position of the instruction.
+	line   int
+	column int
+}
+
+// opcode is the type of a flattened instruction.
+//
+// We use integers, rather than the ir.Kind strings, because they're
+// much cheaper to switch upon in our main loop.
+type opcode int
+
+// These are the instruction-types of our flattened program.
+const (
+	opMovePtr opcode = iota
+	opAddCell
+	opSetCell
+	opMulAdd
+	opScan
+	opOutput
+	opInput
+	opLoopOpen
+	opLoopClose
+)
+
+// opcodes maps the (non-loop) instruction-types of our intermediate
+// form to their flattened equivalents.
+var opcodes = map[ir.Kind]opcode{
+	ir.MovePtr: opMovePtr,
+	ir.AddCell: opAddCell,
+	ir.SetCell: opSetCell,
+	ir.MulAdd:  opMulAdd,
+	ir.Scan:    opScan,
+	ir.Output:  opOutput,
+	ir.Input:   opInput,
+}
+
+// flatten appends the given instructions to our program, converting
+// any loops into explicit open/close instructions which jump to each
+// other.
+func (i *Interpreter) flatten(program []*ir.Instruction) {
+	for _, ins := range program {
+		if ins.Kind == ir.Loop {
+			open := len(i.code)
+			i.code = append(i.code, op{kind: opLoopOpen, line: ins.Line, column: ins.Column})
+			i.flatten(ins.Body)
+
+			end := len(i.code)
+			i.code = append(i.code, op{kind: opLoopClose, target: open, line: ins.Line, column: ins.Column})
+			i.code[open].target = end
+			continue
+		}
+		i.code = append(i.code, op{kind: opcodes[ins.Kind], value: ins.Value, offset: ins.Offset, line: ins.Line, column: ins.Column})
+	}
+}
+
+// InterpreterOption is a function which configures an Interpreter,
+// created via NewInterpreter.
+type InterpreterOption func(*Interpreter)
+
+// WithOptions replaces all of the interpreter's settings, other than the
+// step-limit, with those given.
+func WithOptions(options Options) InterpreterOption {
+	return func(i *Interpreter) {
+		i.options = options
+	}
+}
+
+// WithTapeSize sets the number of cells in the tape.
+//
+// The default is 30,000 cells.
+func WithTapeSize(size int) InterpreterOption {
+	return func(i *Interpreter) {
+		i.options.TapeSize = size
+	}
+}
+
+// WithCellSize sets the width of each cell in bits; 8, 16, 32, or 64.
+//
+// The default is 8 bits.
+func WithCellSize(bits int) InterpreterOption {
+	return func(i *Interpreter) {
+		i.options.CellSize = bits
+	}
+}
+
+// WithEOF sets what happens when input is read at end-of-file; one of
+// EOFZero, EOFMinusOne, or EOFUnchanged.
+//
+// The default is EOFUnchanged.
+func WithEOF(mode string) InterpreterOption {
+	return func(i *Interpreter) {
+		i.options.EOF = mode
+	}
+}
+
+// WithTapeMode sets what happens when the memory-pointer moves past the
+// ends of the tape; one of TapeFixed, TapeCheck, TapeWrap, or TapeGrow.
+//
+// The default is TapeFixed.  A fixed tape is still checked, so a program
+// which moves outside it is stopped with a *BoundsError, just as with
+// TapeCheck, rather than crashing your application.
+func WithTapeMode(mode string) InterpreterOption {
+	return func(i *Interpreter) {
+		i.options.Tape = mode
+	}
+}
+
+// WithOptimization sets the optimization level applied to programs.
+//
+// The default is ir.O2, which enables everything.
+func WithOptimization(level int) InterpreterOption {
+	return func(i *Interpreter) {
+		i.options.Optimization = level
+	}
+}
+
+// WithStepLimit sets the maximum number of instructions a program may
+// execute before it is stopped with a *StepLimitError.
+//
+// Instructions are counted after optimization, so "+++" is a single
+// step, and a search such as "[>]" takes one step for every 1024
+// cells it passes.  The default is zero, which means there is no limit.
+func WithStepLimit(steps int) InterpreterOption {
+	return func(i *Interpreter) {
+		i.limit = steps
+	}
+}
+
+// NewInterpreter returns an interpreter which runs programs reading their
+// input from the given reader, and writing their output to the given
+// writer.
+//
+// The interpreter starts with DefaultOptions, which may be changed by
+// the given options.
+func NewInterpreter(in io.Reader, out io.Writer, options ...InterpreterOption) *Interpreter {
+	i := &Interpreter{
+		reader:  in,
+		writer:  out,
+		options: DefaultOptions(),
+	}
+	for _, option := range options {
+		option(i)
+	}
+	return i
 }
 
 // Generate takes the specified input-program, and executes it.
-func (i *Interpreter) Generate(input string, output string) error {
+func (i *Interpreter) Generate(input string, output string, options Options) error {
+
+	i.reader = os.Stdin
+	i.writer = os.Stdout
+	i.options = options
+
+	return i.Run(input)
+}
+
+// Run executes the given brainfuck program, returning once it has
+// terminated.
+//
+// If the program is not valid an *ir.ValidationError is returned, and
+// a *BoundsError is returned if it accesses memory outside the tape,
+// whatever the tape-mode.  Any output the program printed before a
+// failure is still written.
+func (i *Interpreter) Run(source string) error {
+	return i.RunContext(context.Background(), source)
+}
+
+// RunContext is like Run, but the program is stopped with a
+// *CancelledError if the given context is cancelled, or its deadline
+// passes, before the program terminates.
+//
+// RunContext never panics, whatever the program does, so it is safe to
+// use with programs you don't trust.
+func (i *Interpreter) RunContext(ctx context.Context, source string) error {
 
-	// Create a lexer
-	lex := lexer.New(input)
+	err := i.options.Validate()
+	if err != nil {
+		return err
+	}
 
-	// Store the programs' lexed tokens
-	tok := lex.Next()
-	for tok.Type != lexer.EOF {
-		i.tokens = append(i.tokens, tok)
-		tok = lex.Next()
+	// Parse the program into our intermediate form
+	program, err := parse(source, i.options.Optimization)
+	if err != nil {
+		return err
 	}
 
+	// Store the flattened instructions
+	i.code = nil
+	i.flatten(program)
+
 	// Setup our defaults
 	i.ptr = 0
 	i.offset = 0
+	i.steps = 0
+	i.memory = make([]uint64, i.options.TapeSize)
+	i.mask = ^uint64(0) >> uint(64-i.options.CellSize)
+	i.edges = i.options.Tape == TapeWrap || i.options.Tape == TapeGrow
+	i.in = bufio.NewReader(i.reader)
+	i.out = bufio.NewWriter(i.writer)
 
 	//
 	// Repeatedly evaluate a single instruction, until
 	// we've exhausted our program.
 	//
-	for i.offset < len(i.tokens) {
-		err := i.evaluate()
+	// Checking our limits after every instruction would be
+	// expensive, so we execute them in batches, and check
+	// before each batch.
+	//
+	done := ctx.Done()
+	for i.offset < len(i.code) {
+
+		batch := 1024
+		if i.limit > 0 {
+			batch = i.limit - i.steps
+			if batch > 1024 {
+				batch = 1024
+			}
+		}
+
+		err = i.stopped(ctx, done, batch)
+		n := 0
+		for err == nil && n < batch && i.offset < len(i.code) {
+			err = i.evaluate()
+			n++
+		}
+		i.steps += n
+
 		if err != nil {
+
+			// Anything the program printed before the
+			// failure should still be seen.
+			i.out.Flush()
 			return err
 		}
 	}
 
+	return i.out.Flush()
+}
+
+// stopped returns an error if the program should not continue, either
+// because we may execute no more instructions or because our context
+// has been cancelled.
+func (i *Interpreter) stopped(ctx context.Context, done <-chan struct{}, batch int) error {
+
+	ins := i.code[i.offset]
+
+	if batch <= 0 {
+		return &StepLimitError{Steps: i.steps, Line: ins.line, Column: ins.column}
+	}
+
+	select {
+	case <-done:
+		return &CancelledError{Err: ctx.Err(), Steps: i.steps, Line: ins.line, Column: ins.column}
+	default:
+	}
 	return nil
 }
 
@@ -74,49 +369,92 @@ func (i *Interpreter) Generate(input string, output string) error {
 func (i *Interpreter) evaluate() error {
 
 	//
-	// Get the token we're executing.
+	// Get the instruction we're executing.
 	//
-	tok := i.tokens[i.offset]
+	ins := i.code[i.offset]
 
 	//
 	// Execute it.
 	//
-	switch tok.Type {
+	switch ins.kind {
 
-	case lexer.INC_PTR:
-		i.ptr += tok.Repeat
+	case opMovePtr:
+		i.ptr += ins.value
+		if i.edges {
+			if err := i.move(ins); err != nil {
+				return err
+			}
+		} else if i.outside(i.ptr) {
+			return i.bounds(ins, i.ptr)
+		}
 
-	case lexer.DEC_PTR:
-		i.ptr -= tok.Repeat
+	case opAddCell:
+		cell := i.ptr + ins.offset
+		if i.edges {
+			var err error
+			if cell, err = i.edge(ins, cell); err != nil {
+				return err
+			}
+		} else if i.outside(cell) {
+			return i.bounds(ins, cell)
+		}
+		i.memory[cell] = (i.memory[cell] + uint64(ins.value)) & i.mask
+
+	case opSetCell:
+		cell := i.ptr + ins.offset
+		if i.edges {
+			var err error
+			if cell, err = i.edge(ins, cell); err != nil {
+				return err
+			}
+		} else if i.outside(cell) {
+			return i.bounds(ins, cell)
+		}
+		i.memory[cell] = uint64(ins.value) & i.mask
+
+	case opMulAdd:
+		cell := i.ptr + ins.offset
+		if i.edges {
+			var err error
+			if cell, err = i.edge(ins, cell); err != nil {
+				return err
+			}
+		} else if i.outside(cell) {
+			return i.bounds(ins, cell)
+		}
+		i.memory[cell] = (i.memory[cell] + i.memory[i.ptr]*uint64(ins.value)) & i.mask
 
-	case lexer.INC_CELL:
-		i.memory[i.ptr] += tok.Repeat
+	case opScan:
 
-	case lexer.DEC_CELL:
-		i.memory[i.ptr] -= tok.Repeat
+		// We only search a limited number of cells each time
+		// we're executed, so that a search which never finds a
+		// zero can still be interrupted.
+		for n := 0; i.memory[i.ptr] != 0; n++ {
+			if n == scanBatch {
+				return nil
+			}
+			i.ptr += ins.value
+			if i.edges {
+				if err := i.move(ins); err != nil {
+					return err
+				}
+			} else if i.outside(i.ptr) {
+				return i.bounds(ins, i.ptr)
+			}
+		}
 
-	case lexer.LOOP_OPEN:
+	case opLoopOpen:
 		// early termination
 		if i.memory[i.ptr] != 0 {
 			i.offset++
 			return nil
 		}
 
-		// Otherwise we need to the end of the loop and
-		// jump to it
-		depth := 1
-		for depth != 0 {
-			i.offset++
-			switch i.tokens[i.offset].Type {
-			case lexer.LOOP_OPEN:
-				depth++
-			case lexer.LOOP_CLOSE:
-				depth--
-			}
-		}
+		// Otherwise we jump past the end of the loop
+		i.offset = ins.target + 1
 		return nil
 
-	case lexer.LOOP_CLOSE:
+	case opLoopClose:
 
 		// early termination
 		if i.memory[i.ptr] == 0 {
@@ -124,31 +462,40 @@ func (i *Interpreter) evaluate() error {
 			return nil
 		}
 
-		depth := 1
-		for depth != 0 {
-			i.offset--
-			switch i.tokens[i.offset].Type {
-			case lexer.LOOP_CLOSE:
-				depth++
-			case lexer.LOOP_OPEN:
-				depth--
+		// Otherwise we jump back to the first instruction
+		// inside the loop - there's no need to repeat the
+		// test at the start.
+		i.offset = ins.target + 1
+		return nil
+
+	case opInput:
+		if i.in.Buffered() == 0 {
+			if err := i.out.Flush(); err != nil {
+				return err
 			}
 		}
-		return nil
 
-	case lexer.INPUT:
-		buf := make([]byte, 1)
-		l, err := os.Stdin.Read(buf)
+		c, err := i.in.ReadByte()
+		if err == io.EOF {
+			switch i.options.EOF {
+			case EOFZero:
+				i.memory[i.ptr] = 0
+			case EOFMinusOne:
+				i.memory[i.ptr] = i.mask
+			}
+			break
+		}
 		if err != nil {
 			return err
 		}
-		if l != 1 {
-			return fmt.Errorf("read %d bytes of input, not 1", l)
-		}
-		i.memory[i.ptr] = int(buf[0])
+		i.memory[i.ptr] = uint64(c)
 
-	case lexer.OUTPUT:
-		fmt.Printf("%c", rune(i.memory[i.ptr]))
+	case opOutput:
+		// Only the low byte of a cell is written.
+		err := i.out.WriteByte(byte(i.memory[i.ptr]))
+		if err != nil {
+			return err
+		}
 
 	}
 
@@ -157,6 +504,108 @@ func (i *Interpreter) evaluate() error {
 	return nil
 }
 
+// move applies our tape-mode to the memory-pointer, after it has been
+// moved by the given instruction.
+func (i *Interpreter) move(ins op) error {
+	ptr, err := i.edge(ins, i.ptr)
+	i.ptr = ptr
+	return err
+}
+
+// edge applies our tape-mode to the position of a cell accessed by the
+// given instruction, returning the position which should be used.
+func (i *Interpreter) edge(ins op, cell int) (int, error) {
+	switch i.options.Tape {
+	case TapeGrow:
+		if cell < 0 {
+			return cell, i.bounds(ins, cell)
+		}
+		if cell >= len(i.memory) {
+			i.grow(cell)
+		}
+	case TapeWrap:
+		cell %= len(i.memory)
+		if cell < 0 {
+			cell += len(i.memory)
+		}
+	}
+	return cell, nil
+}
+
+// outside returns true if the given cell is outside our tape.
+func (i *Interpreter) outside(cell int) bool {
+	return uint(cell) >= uint(len(i.memory))
+}
+
+// grow enlarges our tape so that it contains the given cell.
+//
+// The size is doubled each time, so that a program which walks steadily
+// to the right doesn't reallocate on every step.
+func (i *Interpreter) grow(cell int) {
+	size := len(i.memory)
+	for size <= cell {
+		size *= 2
+	}
+	i.memory = append(i.memory, make([]uint64, size-len(i.memory))...)
+}
+
+// bounds returns a *BoundsError if the given cell is outside our tape.
+func (i *Interpreter) bounds(ins op, cell int) error {
+	if cell < 0 || cell >= len(i.memory) {
+		return &BoundsError{Line: ins.line, Column: ins.column}
+	}
+	return nil
+}
+
+// StepLimitError is returned by the interpreter if a program executes
+// more instructions than permitted by WithStepLimit.
+type StepLimitError struct {
+
+	// Steps contains the number of instructions which were executed.
+	Steps int
+
+	// Line contains the line-number of the next instruction.
+	Line int
+
+	// Column contains the column of the next instruction.
+	Column int
+}
+
+// Error implements the error interface.
+func (s *StepLimitError) Error() string {
+	return fmt.Sprintf("step limit exceeded after %d instructions, at line %d, column %d", s.Steps, s.Line, s.Column)
+}
+
+// CancelledError is returned by the interpreter if the context passed to
+// RunContext is cancelled, or its deadline passes, while a program is
+// running.
+type CancelledError struct {
+
+	// Err contains the error from the context; context.Canceled or
+	// context.DeadlineExceeded.
+	Err error
+
+	// Steps contains the number of instructions which were executed.
+	Steps int
+
+	// Line contains the line-number of the next instruction.
+	Line int
+
+	// Column contains the column of the next instruction.
+	Column int
+}
+
+// Error implements the error interface.
+func (c *CancelledError) Error() string {
+	return fmt.Sprintf("%s after %d instructions, at line %d, column %d", c.Err, c.Steps, c.Line, c.Column)
+}
+
+// Unwrap returns the error from the context, so that errors.Is can be
+// used to tell a timeout from a cancellation.
+func (c *CancelledError) Unwrap() error {
+	return c.Err
+}
+
 // Register our back-end
 func init() {
 	Register("interpreter", func() Generator {
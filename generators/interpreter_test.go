@@ -0,0 +1,384 @@
+package generators
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skx/bfcc/ir"
+)
+
+// run executes the given example-program with the interpreter, and
+// returns the output it produced.
+func run(t testing.TB, name string) string {
+
+	src, err := ioutil.ReadFile("../examples/" + name + ".bf")
+	if err != nil {
+		t.Fatalf("failed to read example %s: %s", name, err)
+	}
+
+	// Capture STDOUT
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %s", err)
+	}
+	orig := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = orig }()
+
+	out := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		out <- data
+	}()
+
+	i := &Interpreter{}
+	err = i.Generate(string(src), "", DefaultOptions())
+	w.Close()
+	if err != nil {
+		t.Fatalf("error running example %s: %s", name, err)
+	}
+
+	return string(<-out)
+}
+
+// TestInterpreter runs some of our examples, and compares their output
+// with that expected.
+func TestInterpreter(t *testing.T) {
+
+	for _, name := range []string{"hello-world", "fibonacci", "bizzfuzz", "quine"} {
+
+		expected, err := ioutil.ReadFile("../examples/" + name + ".out")
+		if err != nil {
+			t.Fatalf("failed to read expected output for %s: %s", name, err)
+		}
+
+		got := run(t, name)
+		if got != string(expected) {
+			t.Fatalf("wrong output for %s, got %q", name, got)
+		}
+	}
+}
+
+// TestTapeSize ensures the tape has the number of cells requested.
+func TestTapeSize(t *testing.T) {
+
+	options := DefaultOptions()
+	options.TapeSize = 4
+
+	i := &Interpreter{}
+	err := i.Generate(">>>+", "", options)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(i.memory) != 4 || i.memory[3] != 1 {
+		t.Fatalf("wrong tape %v", i.memory)
+	}
+
+	// An invalid size is an error.
+	options.TapeSize = 0
+	if i.Generate("+", "", options) == nil {
+		t.Fatalf("expected an error from an invalid size")
+	}
+}
+
+// TestCellSize ensures that cells wrap around at the width requested.
+func TestCellSize(t *testing.T) {
+
+	for _, size := range []int{8, 16, 32, 64} {
+		options := DefaultOptions()
+		options.CellSize = size
+
+		i := &Interpreter{}
+		err := i.Generate("-", "", options)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		expected := ^uint64(0) >> uint(64-size)
+		if i.memory[0] != expected {
+			t.Fatalf("%d-bit cells: expected %d, got %d", size, expected, i.memory[0])
+		}
+	}
+}
+
+// TestEOF ensures that reading at end-of-file updates the current cell
+// as requested.
+func TestEOF(t *testing.T) {
+
+	expected := map[string]uint64{EOFZero: 0, EOFMinusOne: 255, EOFUnchanged: 1}
+	for mode, val := range expected {
+		options := DefaultOptions()
+		options.EOF = mode
+
+		// Our input is a single character.
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatalf("failed to create pipe: %s", err)
+		}
+		w.WriteString("a")
+		w.Close()
+
+		orig := os.Stdin
+		os.Stdin = r
+		i := &Interpreter{}
+		err = i.Generate(",>+,", "", options)
+		os.Stdin = orig
+		r.Close()
+
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if i.memory[0] != 'a' || i.memory[1] != val {
+			t.Fatalf("%s: expected %d, got %d", mode, val, i.memory[1])
+		}
+	}
+}
+
+// BenchmarkMandelbrot measures the time taken to interpret our
+// mandelbrot example.
+func BenchmarkMandelbrot(b *testing.B) {
+
+	expected, err := ioutil.ReadFile("../examples/mandelbrot.out")
+	if err != nil {
+		b.Fatalf("failed to read expected output: %s", err)
+	}
+
+	for n := 0; n < b.N; n++ {
+		got := run(b, "mandelbrot")
+		if got != string(expected) {
+			b.Fatalf("wrong output, got %q", got)
+		}
+	}
+}
+
+// TestBounds ensures that out of bounds accesses are reported, when
+// bounds-checking is enabled.
+func TestBounds(t *testing.T) {
+
+	options := DefaultOptions()
+	options.Tape = TapeCheck
+
+	i := &Interpreter{}
+	err := i.Generate("+++\n  <+", "", options)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	bounds, ok := err.(*BoundsError)
+	if !ok {
+		t.Fatalf("wrong error type %T", err)
+	}
+	if bounds.Line != 2 || bounds.Column != 4 {
+		t.Fatalf("wrong position %d:%d", bounds.Line, bounds.Column)
+	}
+}
+
+// TestWrap ensures that the memory-pointer wraps around the ends of the
+// tape, when that is enabled.
+func TestWrap(t *testing.T) {
+
+	options := DefaultOptions()
+	options.Tape = TapeWrap
+	options.TapeSize = 5
+
+	i := &Interpreter{}
+	err := i.Generate("<+<<++>>>>>>>>>>>>>>+++", "", options)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []uint64{0, 3, 2, 0, 1}
+	for n, val := range expected {
+		if i.memory[n] != val {
+			t.Fatalf("cell %d: expected %d, got %d", n, val, i.memory[n])
+		}
+	}
+}
+
+// TestGrow ensures that the tape grows when the memory-pointer moves
+// past the end of it, when that is enabled.
+func TestGrow(t *testing.T) {
+
+	options := DefaultOptions()
+	options.Tape = TapeGrow
+	options.TapeSize = 4
+
+	i := &Interpreter{}
+	err := i.Generate(">>>>>>>>>>+", "", options)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(i.memory) != 16 {
+		t.Fatalf("expected the tape to grow to 16 cells, got %d", len(i.memory))
+	}
+	if i.memory[10] != 1 {
+		t.Fatalf("cell 10: expected 1, got %d", i.memory[10])
+	}
+
+	// Moving before the start of the tape is still an error.
+	err = i.Generate("+<", "", options)
+	if _, ok := err.(*BoundsError); !ok {
+		t.Fatalf("expected a bounds-error, got %v", err)
+	}
+}
+
+// TestRun ensures the interpreter's options are applied, and that it
+// can be used with our own input and output rather than STDIN and STDOUT.
+func TestRun(t *testing.T) {
+
+	var out bytes.Buffer
+
+	i := NewInterpreter(strings.NewReader("ab"), &out, WithTapeSize(4), WithCellSize(16), WithEOF(EOFMinusOne), WithTapeMode(TapeWrap), WithOptimization(0))
+
+	expected := DefaultOptions()
+	expected.TapeSize = 4
+	expected.CellSize = 16
+	expected.EOF = EOFMinusOne
+	expected.Tape = TapeWrap
+	expected.Optimization = 0
+	if !reflect.DeepEqual(i.options, expected) {
+		t.Fatalf("wrong options %+v", i.options)
+	}
+
+	err := i.Run(",+.<,.")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if out.String() != "bb" {
+		t.Fatalf("wrong output %q", out.String())
+	}
+
+	// All of our options may be set at once.
+	expected = Options{TapeSize: 1, CellSize: 32, EOF: EOFZero, Tape: TapeCheck}
+	i = NewInterpreter(strings.NewReader(""), &out, WithOptions(expected))
+	if !reflect.DeepEqual(i.options, expected) {
+		t.Fatalf("wrong options %+v", i.options)
+	}
+}
+
+// TestRunErrors ensures that errors are reported by Run, and that any
+// output printed before them is still written.
+func TestRunErrors(t *testing.T) {
+
+	var out bytes.Buffer
+
+	i := NewInterpreter(strings.NewReader(""), &out, WithTapeMode(TapeCheck))
+	err := i.Run("+++[>++++++++++<-]>+++.<<")
+	if _, ok := err.(*BoundsError); !ok {
+		t.Fatalf("expected a bounds-error, got %v", err)
+	}
+	if out.String() != "!" {
+		t.Fatalf("output was lost, got %q", out.String())
+	}
+
+	// Leaving a fixed tape, which is the default, is reported too.
+	for _, program := range []string{"<+", "+[>+]", "+[<]"} {
+		i = NewInterpreter(strings.NewReader(""), &out)
+		err = i.Run(program)
+		if _, ok := err.(*BoundsError); !ok {
+			t.Fatalf("%s: expected a bounds-error, got %v", program, err)
+		}
+	}
+
+	for _, option := range []InterpreterOption{WithTapeSize(0), WithCellSize(12), WithEOF("bogus"), WithTapeMode("bogus")} {
+		i = NewInterpreter(strings.NewReader(""), &out, option)
+		if i.Run("+") == nil {
+			t.Fatalf("expected an error from an invalid option")
+		}
+	}
+
+	i = NewInterpreter(strings.NewReader(""), &out)
+	if i.Run("[[]") == nil {
+		t.Fatalf("expected an error from an invalid program")
+	}
+}
+
+// TestLimits ensures that runaway programs can be stopped.
+func TestLimits(t *testing.T) {
+
+	var out bytes.Buffer
+
+	// A step-limit.
+	i := NewInterpreter(strings.NewReader(""), &out, WithStepLimit(1000))
+	err := i.Run("+\n [\n]")
+	limit, ok := err.(*StepLimitError)
+	if !ok {
+		t.Fatalf("expected a step-limit error, got %v", err)
+	}
+	if limit.Steps != 1000 || limit.Line != 2 || limit.Column != 2 {
+		t.Fatalf("wrong details %d steps at %d:%d", limit.Steps, limit.Line, limit.Column)
+	}
+
+	// A search which never finds a zero is stopped too.
+	i = NewInterpreter(strings.NewReader(""), &out, WithStepLimit(1000), WithTapeSize(4), WithTapeMode(TapeWrap))
+	err = i.Run("+>+>+>+[>]")
+	if _, ok = err.(*StepLimitError); !ok {
+		t.Fatalf("expected a step-limit error, got %v", err)
+	}
+
+	// A timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	i = NewInterpreter(strings.NewReader(""), &out)
+	err = i.RunContext(ctx, "+[]")
+	cancelled, ok := err.(*CancelledError)
+	if !ok {
+		t.Fatalf("expected a cancelled error, got %v", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to have passed, got %v", cancelled.Err)
+	}
+	if cancelled.Steps == 0 {
+		t.Fatalf("expected some instructions to have been executed")
+	}
+
+	// Leaving the tape is reported, rather than panicking.
+	i = NewInterpreter(strings.NewReader(""), &out)
+	err = i.RunContext(context.Background(), "+[>+]")
+	if _, ok = err.(*BoundsError); !ok {
+		t.Fatalf("expected a bounds-error, got %v", err)
+	}
+}
+
+// TestRoundTrip ensures that converting our examples back to brainfuck
+// doesn't change their behaviour.
+func TestRoundTrip(t *testing.T) {
+
+	for _, name := range []string{"hello-world", "fibonacci", "bizzfuzz", "quine"} {
+
+		src, err := ioutil.ReadFile("../examples/" + name + ".bf")
+		if err != nil {
+			t.Fatalf("failed to read example %s: %s", name, err)
+		}
+		expected, err := ioutil.ReadFile("../examples/" + name + ".out")
+		if err != nil {
+			t.Fatalf("failed to read expected output for %s: %s", name, err)
+		}
+
+		program, err := parse(string(src), ir.O2)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %s", name, err)
+		}
+		bf, err := ir.Brainfuck(program)
+		if err != nil {
+			t.Fatalf("failed to convert %s: %s", name, err)
+		}
+
+		var out bytes.Buffer
+		err = NewInterpreter(strings.NewReader(""), &out, WithOptimization(ir.O0)).Run(bf)
+		if err != nil {
+			t.Fatalf("error running converted %s: %s", name, err)
+		}
+		if out.String() != string(expected) {
+			t.Fatalf("wrong output for converted %s, got %q", name, out.String())
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package generators
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/skx/bfcc/ir"
+)
+
+// Options holds the settings which control how a program is generated.
+//
+// Not every backend uses every setting; for example the interpreter
+// produces no files, so has nothing to cleanup.
+type Options struct {
+
+	// Cleanup is true if any intermediate files should be removed
+	// once the executable has been generated.
+	//
+	// These files are written to a private temporary directory, and
+	// are removed even if compilation fails.
+	Cleanup bool
+
+	// Debug is true if a debugging-breakpoint should be inserted at
+	// the start of the program, where possible.
+	Debug bool
+
+	// TapeSize is the number of cells in the tape.
+	//
+	// When Tape is TapeGrow this is the initial size.
+	TapeSize int
+
+	// CellSize is the width of each cell, in bits; 8, 16, 32, or 64.
+	CellSize int
+
+	// Optimization is the optimization level; ir.O0, ir.O1, or ir.O2.
+	Optimization int
+
+	// EOF describes what happens when input is read at end-of-file;
+	// one of EOFZero, EOFMinusOne, or EOFUnchanged.
+	EOF string
+
+	// Tape describes what happens when the memory-pointer moves past
+	// the ends of the tape; one of TapeFixed, TapeCheck, TapeWrap, or
+	// TapeGrow.
+	Tape string
+
+	// Compiler is the C compiler used by the compiling backends, for
+	// example "gcc" or "clang".  It may be followed by arguments, as
+	// in "ccache gcc".  If empty gcc is used.
+	Compiler string
+
+	// CFlags contains extra flags to pass to the compiler, after the
+	// ones the backend chooses itself.
+	CFlags []string
+
+	// LDFlags contains the flags used when linking the executable.
+	//
+	// By default this is "-static", which you might wish to remove
+	// if your system lacks a static C library.
+	LDFlags []string
+}
+
+// DefaultOptions returns the options used if the user doesn't choose
+// anything different.
+func DefaultOptions() Options {
+	return Options{
+		Cleanup:      true,
+		TapeSize:     30000,
+		CellSize:     8,
+		Optimization: ir.O2,
+		EOF:          EOFUnchanged,
+		Tape:         TapeFixed,
+		Compiler:     "gcc",
+		LDFlags:      []string{"-static"},
+	}
+}
+
+// Validate returns an error if any of the options are invalid.
+func (o Options) Validate() error {
+
+	if o.TapeSize < 1 {
+		return fmt.Errorf("the tape must contain at least one cell")
+	}
+
+	if o.CellSize != 8 && o.CellSize != 16 && o.CellSize != 32 && o.CellSize != 64 {
+		return fmt.Errorf("the cell-size must be one of 8, 16, 32, or 64")
+	}
+
+	if o.Optimization < ir.O0 || o.Optimization > ir.O2 {
+		return fmt.Errorf("the optimization level must be between %d and %d", ir.O0, ir.O2)
+	}
+
+	if o.EOF != EOFZero && o.EOF != EOFMinusOne && o.EOF != EOFUnchanged {
+		return fmt.Errorf("the eof-mode must be one of zero, minus-one, or unchanged")
+	}
+
+	if o.Tape != TapeFixed && o.Tape != TapeCheck && o.Tape != TapeWrap && o.Tape != TapeGrow {
+		return fmt.Errorf("the tape-mode must be one of fixed, check, wrap, or grow")
+	}
+
+	return nil
+}
+
+// compiler returns the command which runs the C compiler; the name of
+// the program followed by any arguments which precede our own.
+func (o Options) compiler() []string {
+	cc := strings.Fields(o.Compiler)
+	if len(cc) == 0 {
+		return []string{"gcc"}
+	}
+	return cc
+}
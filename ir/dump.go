@@ -0,0 +1,190 @@
+package ir
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Dump returns a human-readable description of the given program, with
+// one instruction on each line, prefixed by its source-position.
+//
+// The bodies of loops are indented beneath them.
+func Dump(program []*Instruction) string {
+	var buff bytes.Buffer
+	dump(&buff, program, 0)
+	return buff.String()
+}
+
+// dump writes the description of the given instructions to the buffer,
+// indented by the given depth.
+func dump(buff *bytes.Buffer, program []*Instruction, depth int) {
+
+	indent := strings.Repeat("  ", depth)
+
+	for _, ins := range program {
+
+		buff.WriteString(fmt.Sprintf("%d:%d\t%s%s", ins.Line, ins.Column, indent, ins.Kind))
+
+		switch ins.Kind {
+		case AddCell, SetCell, MulAdd:
+			buff.WriteString(fmt.Sprintf(" %d", ins.Value))
+			if ins.Offset != 0 {
+				buff.WriteString(fmt.Sprintf(" [%+d]", ins.Offset))
+			}
+		case MovePtr, Scan:
+			buff.WriteString(fmt.Sprintf(" %d", ins.Value))
+		}
+		buff.WriteString("\n")
+
+		if ins.Kind == Loop {
+			dump(buff, ins.Body, depth+1)
+		}
+	}
+}
+
+// Brainfuck converts the given program back into brainfuck source-code.
+//
+// The result is canonical, containing nothing but the eight brainfuck
+// characters, wrapped at 72 columns.  Optimized instructions are written
+// as the simplest equivalent, so "[+]" becomes "[-]".
+//
+// MulAdd instructions can only be converted within the loops created by
+// our optimizer, which zero the current cell, and will otherwise cause
+// an error to be returned.
+func Brainfuck(program []*Instruction) (string, error) {
+
+	w := &writer{}
+	err := w.program(program)
+	if err != nil {
+		return "", err
+	}
+	w.write("")
+
+	// Wrap the output into lines of a sensible length.
+	var out strings.Builder
+	src := w.buff.String()
+	for len(src) > 72 {
+		out.WriteString(src[:72] + "\n")
+		src = src[72:]
+	}
+	if src != "" {
+		out.WriteString(src + "\n")
+	}
+	return out.String(), nil
+}
+
+// writer holds the state used when converting a program back into
+// brainfuck.
+//
+// Movements of the memory-pointer are delayed until something else is
+// written, so that neighbouring movements cancel out rather than being
+// written as "><".
+type writer struct {
+	buff bytes.Buffer
+
+	// pending is the distance the pointer has yet to be moved.
+	pending int
+}
+
+// program writes the brainfuck source-code for the given instructions.
+func (w *writer) program(program []*Instruction) error {
+
+	for _, ins := range program {
+
+		switch ins.Kind {
+		case AddCell:
+			w.move(ins.Offset)
+			w.add(ins.Value)
+			w.move(-ins.Offset)
+		case SetCell:
+			w.move(ins.Offset)
+			w.write("[-]")
+			w.add(ins.Value)
+			w.move(-ins.Offset)
+		case MovePtr:
+			w.move(ins.Value)
+		case Output:
+			w.write(".")
+		case Input:
+			w.write(",")
+		case Scan:
+			w.write("[")
+			w.move(ins.Value)
+			w.write("]")
+		case Loop:
+
+			// A loop of multiplications is written as the loop
+			// which it was created from.
+			if isMulLoop(ins.Body) {
+				w.write("[-")
+				for _, mul := range ins.Body[:len(ins.Body)-1] {
+					w.move(mul.Offset)
+					w.add(mul.Value)
+					w.move(-mul.Offset)
+				}
+				w.write("]")
+				continue
+			}
+
+			w.write("[")
+			err := w.program(ins.Body)
+			if err != nil {
+				return err
+			}
+			w.write("]")
+		default:
+			return fmt.Errorf("%d:%d: cannot convert %s to brainfuck", ins.Line, ins.Column, ins.Kind)
+		}
+	}
+
+	return nil
+}
+
+// move records that the memory-pointer should be moved by the given
+// amount.
+func (w *writer) move(n int) {
+	w.pending += n
+}
+
+// add writes the characters to add the given amount to the current cell.
+func (w *writer) add(n int) {
+	if n > 0 {
+		w.write(strings.Repeat("+", n))
+	} else {
+		w.write(strings.Repeat("-", -n))
+	}
+}
+
+// write writes the given characters, after any pending movement of the
+// memory-pointer.
+func (w *writer) write(s string) {
+	if w.pending > 0 {
+		w.buff.WriteString(strings.Repeat(">", w.pending))
+	} else {
+		w.buff.WriteString(strings.Repeat("<", -w.pending))
+	}
+	w.pending = 0
+	w.buff.WriteString(s)
+}
+
+// isMulLoop returns true if the given loop body was created by mulLoops;
+// a series of MulAdd instructions followed by zeroing the current cell.
+func isMulLoop(body []*Instruction) bool {
+
+	if len(body) < 2 {
+		return false
+	}
+
+	last := body[len(body)-1]
+	if last.Kind != SetCell || last.Value != 0 || last.Offset != 0 {
+		return false
+	}
+
+	for _, ins := range body[:len(body)-1] {
+		if ins.Kind != MulAdd {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,399 @@
+// Package ir contains the intermediate representation of a BrainFuck
+// program.
+//
+// The lexer gives us a flat stream of tokens, which we convert into a
+// list of typed instructions.  Loops are represented as a single
+// instruction which contains the body of the loop, so brackets never
+// need to be matched up again once the program has been parsed.
+//
+// Our backends consume this representation rather than the raw tokens,
+// which means any optimization we perform here is shared by all of them.
+package ir
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/skx/bfcc/lexer"
+)
+
+// Kind describes the type of a single instruction.
+type Kind string
+
+// These constants are our instruction-types.
+const (
+	// AddCell adds Value to the cell Offset places away from the
+	// memory-pointer.
+	AddCell Kind = "AddCell"
+
+	// MovePtr adds Value to the memory-pointer.
+	MovePtr Kind = "MovePtr"
+
+	// SetCell stores Value in the cell Offset places away from the
+	// memory-pointer.
+	SetCell Kind = "SetCell"
+
+	// Output writes the current cell to STDOUT.
+	Output Kind = "Output"
+
+	// Input reads a character from STDIN into the current cell.
+	Input Kind = "Input"
+
+	// Loop executes Body while the current cell is non-zero.
+	Loop Kind = "Loop"
+
+	// MulAdd adds the current cell, multiplied by Value, to the cell
+	// Offset places away from the memory-pointer.
+	MulAdd Kind = "MulAdd"
+
+	// Scan moves the memory-pointer by Value until it finds a cell
+	// which contains zero.
+	Scan Kind = "Scan"
+)
+
+// Instruction is a single operation within our program.
+type Instruction struct {
+
+	// Kind contains the instruction-type.
+	Kind Kind
+
+	// Value holds the argument of the instruction, if it has one.
+	//
+	// For AddCell, MovePtr, MulAdd and Scan it may be negative.
+	Value int
+
+	// Offset contains the position of the cell which is modified,
+	// relative to the memory-pointer, for AddCell, SetCell and MulAdd.
+	Offset int
+
+	// Body contains the instructions inside a Loop.
+	Body []*Instruction
+
+	// Line contains the line-number of the source this instruction
+	// was created from.
+	//
+	// When instructions are merged this is the position of the first.
+	Line int
+
+	// Column contains the column of the source this instruction was
+	// created from.
+	Column int
+}
+
+// TokenError is returned by Parse if it is given a token which it
+// doesn't know how to handle.
+type TokenError struct {
+
+	// Token contains the type of the token.
+	Token string
+
+	// Line contains the line-number of the token, starting from 1.
+	Line int
+
+	// Column contains the column of the token, starting from 1.
+	Column int
+}
+
+// Error implements the error interface.
+func (t *TokenError) Error() string {
+	return fmt.Sprintf("%d:%d: unsupported token '%s'", t.Line, t.Column, t.Token)
+}
+
+// Parse converts the given tokens into a list of instructions.
+//
+// Adjacent instructions which modify the same thing are merged
+// together, so "+-" and "<>" will disappear entirely.
+//
+// If the brackets in the program are unbalanced a *ValidationError
+// is returned, and if a token is not recognized a *TokenError is
+// returned.
+func Parse(tokens []*lexer.Token) ([]*Instruction, error) {
+
+	err := validate("", tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	//
+	// The instructions we're currently appending to, and
+	// the parents of that list - one for each open loop.
+	//
+	var current []*Instruction
+	var parents [][]*Instruction
+
+	// The tokens which opened each loop.
+	var opens []*lexer.Token
+
+	for _, tok := range tokens {
+
+		switch tok.Type {
+
+		case lexer.INC_CELL:
+			current = appendArith(current, AddCell, tok.Repeat, tok)
+		case lexer.DEC_CELL:
+			current = appendArith(current, AddCell, -tok.Repeat, tok)
+		case lexer.INC_PTR:
+			current = appendArith(current, MovePtr, tok.Repeat, tok)
+		case lexer.DEC_PTR:
+			current = appendArith(current, MovePtr, -tok.Repeat, tok)
+		case lexer.OUTPUT:
+			for n := 0; n < tok.Repeat; n++ {
+				current = append(current, &Instruction{Kind: Output, Line: tok.Line, Column: tok.Column})
+			}
+		case lexer.INPUT:
+			for n := 0; n < tok.Repeat; n++ {
+				current = append(current, &Instruction{Kind: Input, Line: tok.Line, Column: tok.Column})
+			}
+
+		case lexer.LOOP_OPEN:
+			parents = append(parents, current)
+			opens = append(opens, tok)
+			current = nil
+
+		case lexer.LOOP_CLOSE:
+			open := opens[len(opens)-1]
+			loop := &Instruction{Kind: Loop, Body: current, Line: open.Line, Column: open.Column}
+
+			current = parents[len(parents)-1]
+			parents = parents[:len(parents)-1]
+			opens = opens[:len(opens)-1]
+			current = append(current, loop)
+
+		default:
+			return nil, &TokenError{Token: tok.Type, Line: tok.Line, Column: tok.Column}
+		}
+	}
+
+	return current, nil
+}
+
+// appendArith adds an AddCell or MovePtr instruction to the given list,
+// merging it with the previous instruction if that has the same kind.
+//
+// The token is used to record the source-position of new instructions.
+func appendArith(list []*Instruction, kind Kind, value int, tok *lexer.Token) []*Instruction {
+
+	if len(list) > 0 && list[len(list)-1].Kind == kind {
+		list[len(list)-1].Value += value
+
+		// If the two cancelled out then drop the instruction.
+		if list[len(list)-1].Value == 0 {
+			list = list[:len(list)-1]
+		}
+		return list
+	}
+
+	return append(list, &Instruction{Kind: kind, Value: value, Line: tok.Line, Column: tok.Column})
+}
+
+// These constants are our optimization levels.
+const (
+	// O0 disables all optimization passes.
+	O0 = 0
+
+	// O1 converts "[-]" into an explicit zeroing of the current cell.
+	O1 = 1
+
+	// O2 enables every optimization pass.
+	O2 = 2
+)
+
+// passes holds our optimization passes, in the order they're run, along
+// with the level at which each is enabled.
+var passes = []struct {
+	level int
+	pass  func([]*Instruction) []*Instruction
+}{
+	{O1, clearLoops},
+	{O2, offsets},
+	{O2, mulLoops},
+	{O2, scanLoops},
+}
+
+// Optimize applies the optimization passes enabled at the given level
+// to the program, returning the updated version.
+func Optimize(program []*Instruction, level int) []*Instruction {
+	for _, p := range passes {
+		if level >= p.level {
+			program = p.pass(program)
+		}
+	}
+	return program
+}
+
+// clearLoops converts the idiom "[-]", and "[+]", into an explicit
+// setting of the current cell to zero.
+func clearLoops(program []*Instruction) []*Instruction {
+
+	for i, ins := range program {
+
+		if ins.Kind != Loop {
+			continue
+		}
+
+		if len(ins.Body) == 1 &&
+			ins.Body[0].Kind == AddCell &&
+			(ins.Body[0].Value == 1 || ins.Body[0].Value == -1) {
+			program[i] = &Instruction{Kind: SetCell, Value: 0, Line: ins.Line, Column: ins.Column}
+			continue
+		}
+
+		ins.Body = clearLoops(ins.Body)
+	}
+
+	return program
+}
+
+// mulLoops converts simple loops which move values between cells, such
+// as "[->+>++<<]", into a series of multiplications.
+//
+// A loop can be converted if it contains nothing but AddCell and MovePtr
+// instructions, leaves the memory-pointer where it started, and
+// decrements the current cell by one each time around.  In that case the
+// loop runs exactly as many times as the initial value of the cell, so
+// every other cell it touches is incremented by that value multiplied by
+// the amount the body adds to it.
+//
+// The multiplications are left inside the loop, which now runs at most
+// once because its body finishes by zeroing the current cell.  This
+// ensures we never touch the other cells when the original loop would
+// have been skipped.
+func mulLoops(program []*Instruction) []*Instruction {
+
+	for _, ins := range program {
+
+		if ins.Kind != Loop {
+			continue
+		}
+
+		deltas, ok := loopDeltas(ins.Body)
+		if !ok || deltas[0] != -1 {
+			ins.Body = mulLoops(ins.Body)
+			continue
+		}
+
+		// Output the multiplications in order of their offset,
+		// so our output is stable.
+		var offsets []int
+		for offset, value := range deltas {
+			if offset != 0 && value != 0 {
+				offsets = append(offsets, offset)
+			}
+		}
+		sort.Ints(offsets)
+
+		var body []*Instruction
+		for _, offset := range offsets {
+			body = append(body, &Instruction{Kind: MulAdd, Value: deltas[offset], Offset: offset, Line: ins.Line, Column: ins.Column})
+		}
+
+		// Finally the loop leaves the current cell at zero.
+		body = append(body, &Instruction{Kind: SetCell, Value: 0, Line: ins.Line, Column: ins.Column})
+		ins.Body = body
+	}
+
+	return program
+}
+
+// loopDeltas returns the total amount added to each cell, keyed by the
+// offset from the starting position, by a loop body.
+//
+// If the body contains anything other than AddCell and MovePtr, or
+// does not leave the memory-pointer where it started, then false is
+// returned.
+func loopDeltas(body []*Instruction) (map[int]int, bool) {
+
+	deltas := make(map[int]int)
+	pos := 0
+
+	for _, ins := range body {
+		switch ins.Kind {
+		case AddCell:
+			deltas[pos+ins.Offset] += ins.Value
+		case MovePtr:
+			pos += ins.Value
+		default:
+			return nil, false
+		}
+	}
+
+	return deltas, pos == 0
+}
+
+// scanLoops converts loops which search for a zero-cell, such as "[>]",
+// "[<]", or "[>>>]", into a single Scan instruction.
+func scanLoops(program []*Instruction) []*Instruction {
+
+	for i, ins := range program {
+
+		if ins.Kind != Loop {
+			continue
+		}
+
+		if len(ins.Body) == 1 && ins.Body[0].Kind == MovePtr {
+			program[i] = &Instruction{Kind: Scan, Value: ins.Body[0].Value, Line: ins.Line, Column: ins.Column}
+			continue
+		}
+
+		ins.Body = scanLoops(ins.Body)
+	}
+
+	return program
+}
+
+// offsets removes pointer-movement from runs of instructions which
+// modify cells, such as ">+>++<<-", giving each of them an offset
+// instead.
+//
+// The memory-pointer is only updated, with a single MovePtr, when it
+// matters: before a loop is tested, before input or output, and at the
+// end of the program.  It has the position of the first movement it
+// replaces, so that errors are reported against that.
+func offsets(program []*Instruction) []*Instruction {
+
+	var result []*Instruction
+
+	// pos is the distance the memory-pointer should have moved,
+	// but which we've not yet applied.
+	pos := 0
+
+	// from is the first instruction which contributed to that
+	// movement, and gives its position in the source.
+	var from *Instruction
+
+	// move applies any outstanding pointer-movement.
+	move := func() {
+		if pos != 0 {
+			result = append(result, &Instruction{Kind: MovePtr, Value: pos, Line: from.Line, Column: from.Column})
+		}
+		pos = 0
+		from = nil
+	}
+
+	for _, ins := range program {
+
+		switch ins.Kind {
+		case MovePtr:
+			if from == nil {
+				from = ins
+			}
+			pos += ins.Value
+			continue
+		case AddCell, SetCell:
+			ins.Offset += pos
+		case Loop:
+			move()
+			ins.Body = offsets(ins.Body)
+		default:
+			move()
+		}
+
+		result = append(result, ins)
+	}
+
+	// The final movement must happen before the end of the loop,
+	// or program, is reached.
+	move()
+
+	return result
+}
@@ -0,0 +1,370 @@
+package ir
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/skx/bfcc/lexer"
+)
+
+// parse is a helper to lex and parse the given program.
+func parse(t *testing.T, input string) []*Instruction {
+	program, err := Parse(lexer.New(input).Tokens())
+	if err != nil {
+		t.Fatalf("unexpected error parsing %q: %s", input, err)
+	}
+	return program
+}
+
+// TestParse ensures simple programs are converted correctly.
+func TestParse(t *testing.T) {
+
+	program := parse(t, "+++>>-<.,[->+<]")
+
+	tests := []struct {
+		kind  Kind
+		value int
+	}{
+		{AddCell, 3},
+		{MovePtr, 2},
+		{AddCell, -1},
+		{MovePtr, -1},
+		{Output, 0},
+		{Input, 0},
+		{Loop, 0},
+	}
+
+	if len(program) != len(tests) {
+		t.Fatalf("wrong number of instructions, expected=%d, got=%d", len(tests), len(program))
+	}
+
+	for i, tt := range tests {
+		if program[i].Kind != tt.kind {
+			t.Fatalf("tests[%d] - kind wrong, expected=%q, got=%q", i, tt.kind, program[i].Kind)
+		}
+		if program[i].Value != tt.value {
+			t.Fatalf("tests[%d] - value wrong, expected=%d, got=%d", i, tt.value, program[i].Value)
+		}
+	}
+
+	// The loop body should be present
+	body := program[len(program)-1].Body
+	if len(body) != 4 {
+		t.Fatalf("loop body has wrong length, got %d", len(body))
+	}
+}
+
+// TestMerge ensures that adjacent operations are merged, and removed
+// when they cancel out.
+func TestMerge(t *testing.T) {
+
+	program := parse(t, "+++--><<>+")
+
+	if len(program) != 1 {
+		t.Fatalf("expected a single instruction, got %d", len(program))
+	}
+	if program[0].Kind != AddCell || program[0].Value != 2 {
+		t.Fatalf("unexpected instruction %v", program[0])
+	}
+}
+
+// TestUnbalanced ensures unbalanced programs are rejected.
+func TestUnbalanced(t *testing.T) {
+
+	for _, input := range []string{"[", "]", "[[]", "[]]", "]["} {
+		_, err := Parse(lexer.New(input).Tokens())
+		if _, ok := err.(*ValidationError); !ok {
+			t.Fatalf("expected validation error parsing %q, got %v", input, err)
+		}
+	}
+}
+
+// TestUnsupported ensures unknown tokens are reported, along with their
+// position.
+func TestUnsupported(t *testing.T) {
+
+	tokens := []*lexer.Token{
+		{Type: lexer.INC_CELL, Repeat: 1, Line: 1, Column: 1},
+		{Type: "#", Repeat: 1, Line: 2, Column: 3},
+	}
+
+	_, err := Parse(tokens)
+	tok, ok := err.(*TokenError)
+	if !ok {
+		t.Fatalf("expected a token error, got %v", err)
+	}
+	if tok.Token != "#" || tok.Line != 2 || tok.Column != 3 {
+		t.Fatalf("wrong details %s at %d:%d", tok.Token, tok.Line, tok.Column)
+	}
+}
+
+// TestClearLoops ensures "[-]" and "[+]" are optimized.
+func TestClearLoops(t *testing.T) {
+
+	for _, input := range []string{"[-]", "[+]", "[[-]]"} {
+		program := Optimize(parse(t, input), O2)
+
+		// Find the innermost instruction
+		ins := program[0]
+		for ins.Kind == Loop {
+			ins = ins.Body[0]
+		}
+		if ins.Kind != SetCell || ins.Value != 0 {
+			t.Fatalf("expected %q to be optimized, got %v", input, ins)
+		}
+	}
+
+	// "[--]" is not a clear-loop, it never terminates on an odd value
+	program := Optimize(parse(t, "[--]"), O2)
+	if program[0].Kind != Loop {
+		t.Fatalf("expected a loop, got %v", program[0])
+	}
+}
+
+// TestValidate ensures all unmatched brackets are reported, with their
+// positions.
+func TestValidate(t *testing.T) {
+
+	if err := Validate("ok.bf", "+[>[-]<]\n[]"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	err := Validate("bad.bf", "]+[\n  [-]\n]]\n[")
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	v, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("wrong error type %T", err)
+	}
+
+	tests := []struct {
+		bracket string
+		line    int
+		column  int
+	}{
+		{"]", 1, 1},
+		{"]", 3, 2},
+		{"[", 4, 1},
+	}
+
+	if len(v.Errors) != len(tests) {
+		t.Fatalf("wrong number of errors, expected=%d, got=%d", len(tests), len(v.Errors))
+	}
+	for i, tt := range tests {
+		e := v.Errors[i]
+		if e.Bracket != tt.bracket || e.Line != tt.line || e.Column != tt.column {
+			t.Fatalf("tests[%d] - wrong error, got %s", i, e)
+		}
+		if e.File != "bad.bf" {
+			t.Fatalf("tests[%d] - wrong file %q", i, e.File)
+		}
+	}
+
+	expected := "bad.bf:1:1: unmatched ']'\nbad.bf:3:2: unmatched ']'\nbad.bf:4:1: unmatched '['"
+	if err.Error() != expected {
+		t.Fatalf("wrong error message, got %q", err.Error())
+	}
+}
+
+// TestMulLoops ensures copy/multiplication loops are optimized.
+func TestMulLoops(t *testing.T) {
+
+	program := Optimize(parse(t, "[->+>+++<<<--->]"), O2)
+	if len(program) != 1 || program[0].Kind != Loop {
+		t.Fatalf("expected a single loop, got %v", program)
+	}
+	body := program[0].Body
+
+	tests := []struct {
+		kind   Kind
+		value  int
+		offset int
+	}{
+		{MulAdd, -3, -1},
+		{MulAdd, 1, 1},
+		{MulAdd, 3, 2},
+		{SetCell, 0, 0},
+	}
+
+	if len(body) != len(tests) {
+		t.Fatalf("wrong number of instructions, expected=%d, got=%d", len(tests), len(body))
+	}
+	for i, tt := range tests {
+		ins := body[i]
+		if ins.Kind != tt.kind || ins.Value != tt.value || ins.Offset != tt.offset {
+			t.Fatalf("tests[%d] - wrong instruction, got %v", i, ins)
+		}
+	}
+
+	// These loops cannot be converted.
+	for _, input := range []string{"[->+<<]", "[-->+<]", "[->.<]", "[->[-]<]", "[+>+<]"} {
+		program = Optimize(parse(t, input), O2)
+		for _, ins := range program[0].Body {
+			if ins.Kind == MulAdd {
+				t.Fatalf("expected %q to remain unchanged, got %v", input, ins)
+			}
+		}
+	}
+}
+
+// TestScanLoops ensures loops searching for a zero-cell are optimized.
+func TestScanLoops(t *testing.T) {
+
+	tests := []struct {
+		input string
+		value int
+	}{
+		{"[>]", 1},
+		{"[<]", -1},
+		{"[>>>]", 3},
+		{"[<<<<]", -4},
+	}
+
+	for _, tt := range tests {
+		program := Optimize(parse(t, tt.input), O2)
+		if len(program) != 1 || program[0].Kind != Scan || program[0].Value != tt.value {
+			t.Fatalf("expected %q to become a scan, got %v", tt.input, program[0])
+		}
+	}
+}
+
+// TestOffsets ensures pointer-movement is folded into cell offsets.
+func TestOffsets(t *testing.T) {
+
+	program := Optimize(parse(t, ">+>++<<-.>>[>+<<]"), O2)
+
+	tests := []struct {
+		kind   Kind
+		value  int
+		offset int
+	}{
+		{AddCell, 1, 1},
+		{AddCell, 2, 2},
+		{AddCell, -1, 0},
+		{Output, 0, 0},
+		{MovePtr, 2, 0},
+		{Loop, 0, 0},
+	}
+
+	if len(program) != len(tests) {
+		t.Fatalf("wrong number of instructions, expected=%d, got=%d", len(tests), len(program))
+	}
+	for i, tt := range tests {
+		ins := program[i]
+		if ins.Kind != tt.kind || ins.Value != tt.value || ins.Offset != tt.offset {
+			t.Fatalf("tests[%d] - wrong instruction, got %v", i, ins)
+		}
+	}
+
+	// The net movement of the loop happens before it ends.
+	body := program[len(program)-1].Body
+	if len(body) != 2 || body[0].Offset != 1 || body[1].Kind != MovePtr || body[1].Value != -1 {
+		t.Fatalf("unexpected loop body %v %v", body[0], body[1])
+	}
+}
+
+// TestLevels ensures that the optimization level controls which passes
+// are applied.
+func TestLevels(t *testing.T) {
+
+	tests := []struct {
+		level int
+		kinds []Kind
+	}{
+		{O0, []Kind{MovePtr, AddCell, Loop, Loop}},
+		{O1, []Kind{MovePtr, AddCell, SetCell, Loop}},
+		{O2, []Kind{AddCell, SetCell, MovePtr, Scan}},
+	}
+
+	for _, tt := range tests {
+		program := Optimize(parse(t, ">+[-][>]"), tt.level)
+
+		if len(program) != len(tt.kinds) {
+			t.Fatalf("level %d - wrong number of instructions, expected=%d, got=%d", tt.level, len(tt.kinds), len(program))
+		}
+		for i, kind := range tt.kinds {
+			if program[i].Kind != kind {
+				t.Fatalf("level %d - instruction %d wrong, expected=%q, got=%q", tt.level, i, kind, program[i].Kind)
+			}
+		}
+	}
+}
+
+// TestDump ensures our description of a program is correct.
+func TestDump(t *testing.T) {
+
+	program := Optimize(parse(t, "++\n>[->++<]<[<]."), O2)
+
+	expected := `1:1	AddCell 2
+2:1	MovePtr 1
+2:2	Loop
+2:2	  MulAdd 2 [+1]
+2:2	  SetCell 0
+2:9	MovePtr -1
+2:10	Scan -1
+2:13	Output
+`
+	got := Dump(program)
+	if got != expected {
+		t.Fatalf("wrong dump, expected:\n%s\ngot:\n%s", expected, got)
+	}
+}
+
+// TestBrainfuck ensures programs are converted back to brainfuck, and
+// that doing so is stable.
+func TestBrainfuck(t *testing.T) {
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"+++ Comment >>-<<", "+++>>-<<\n"},
+		{"[+]>[<]", "[-]>[<]\n"},
+		{"+[->+>++<<]", "+[->+>++<<]\n"},
+		{"+><-", ""},
+	}
+
+	for _, test := range tests {
+		got, err := Brainfuck(Optimize(parse(t, test.input), O2))
+		if err != nil {
+			t.Fatalf("unexpected error converting %q: %s", test.input, err)
+		}
+		if got != test.expected {
+			t.Fatalf("wrong output for %q, expected %q got %q", test.input, test.expected, got)
+		}
+	}
+
+	// Converting our examples twice should give the same result.
+	files, err := filepath.Glob("../examples/*.bf")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("failed to find examples: %v", err)
+	}
+
+	for _, file := range files {
+		src, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("failed to read %s: %s", file, err)
+		}
+
+		once, err := Brainfuck(Optimize(parse(t, string(src)), O2))
+		if err != nil {
+			t.Fatalf("unexpected error converting %s: %s", file, err)
+		}
+		twice, err := Brainfuck(Optimize(parse(t, once), O2))
+		if err != nil {
+			t.Fatalf("unexpected error converting %s again: %s", file, err)
+		}
+		if once != twice {
+			t.Fatalf("converting %s is not stable", file)
+		}
+	}
+
+	// MulAdd can't be converted by itself.
+	_, err = Brainfuck([]*Instruction{{Kind: MulAdd, Value: 2, Offset: 1, Line: 1, Column: 1}})
+	if err == nil {
+		t.Fatalf("expected an error converting a bare MulAdd")
+	}
+}
@@ -0,0 +1,103 @@
+package ir
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/skx/bfcc/lexer"
+)
+
+// BracketError describes a single unmatched bracket within a program.
+type BracketError struct {
+
+	// File contains the name of the file the program was read from,
+	// if known.
+	File string
+
+	// Bracket contains the unmatched character, "[" or "]".
+	Bracket string
+
+	// Line contains the line-number of the bracket, starting from 1.
+	Line int
+
+	// Column contains the column of the bracket, starting from 1.
+	Column int
+}
+
+// Error implements the error interface.
+func (b *BracketError) Error() string {
+	msg := fmt.Sprintf("%d:%d: unmatched '%s'", b.Line, b.Column, b.Bracket)
+	if b.File != "" {
+		msg = b.File + ":" + msg
+	}
+	return msg
+}
+
+// ValidationError is returned when a program fails validation, and
+// contains every problem which was found.
+type ValidationError struct {
+
+	// Errors holds the individual problems, in the order they
+	// appear within the source.
+	Errors []*BracketError
+}
+
+// Error implements the error interface.
+func (v *ValidationError) Error() string {
+	var msgs []string
+	for _, e := range v.Errors {
+		msgs = append(msgs, e.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Validate ensures that the brackets within the given program are
+// balanced.
+//
+// The name of the file is only used for reporting errors, and may be
+// empty.  If any brackets are unmatched a *ValidationError is returned
+// which describes all of them.
+func Validate(file string, source string) error {
+	return validate(file, lexer.New(source).Tokens())
+}
+
+// validate ensures that the brackets within the given tokens are
+// balanced.
+func validate(file string, tokens []*lexer.Token) error {
+
+	var problems []*BracketError
+
+	// The brackets which are currently open.
+	var opens []*BracketError
+
+	for _, tok := range tokens {
+
+		switch tok.Type {
+		case lexer.LOOP_OPEN:
+			opens = append(opens, &BracketError{File: file, Bracket: "[", Line: tok.Line, Column: tok.Column})
+		case lexer.LOOP_CLOSE:
+			if len(opens) < 1 {
+				problems = append(problems, &BracketError{File: file, Bracket: "]", Line: tok.Line, Column: tok.Column})
+			} else {
+				opens = opens[:len(opens)-1]
+			}
+		}
+	}
+
+	// Anything still open was never closed.
+	problems = append(problems, opens...)
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	// Report them in source-order.
+	sort.Slice(problems, func(a, b int) bool {
+		if problems[a].Line != problems[b].Line {
+			return problems[a].Line < problems[b].Line
+		}
+		return problems[a].Column < problems[b].Column
+	})
+	return &ValidationError{Errors: problems}
+}
@@ -8,10 +8,11 @@
 // As an optimization we collapse multiple adjacent tokens together, and
 // return their type as well as a count of how many times the character
 // was repeated.
+//
+// Every token records the position it was found at within the input, so
+// that later stages can map things back to the source.
 package lexer
 
-import "strings"
-
 // These constants are our token-types
 const (
 	EOF = "EOF"
@@ -38,6 +39,25 @@ type Token struct {
 	// Repeat contains the number of consecutive appearances we've seen
 	// of this token.
 	Repeat int
+
+	// Offset contains the byte-offset of the start of the token
+	// within the input.
+	Offset int
+
+	// End contains the byte-offset immediately after the last
+	// character of the token.
+	//
+	// When repeated characters are collapsed this may include
+	// whitespace which was found between them.
+	End int
+
+	// Line contains the line-number of the start of the token,
+	// starting from 1.
+	Line int
+
+	// Column contains the column of the start of the token, in
+	// characters, starting from 1.
+	Column int
 }
 
 // Lexer holds our lexer state.
@@ -49,6 +69,12 @@ type Lexer struct {
 	// position is the current position within the input-string.
 	position int
 
+	// line is the line-number of our current position.
+	line int
+
+	// column is the column of our current position.
+	column int
+
 	// simple map of single-character tokens to their type
 	known map[string]string
 
@@ -62,12 +88,7 @@ type Lexer struct {
 func New(input string) *Lexer {
 
 	// Create the lexer object.
-	l := &Lexer{input: input}
-
-	// Strip newlines/spaces from our iput
-	l.input = strings.ReplaceAll(l.input, "\n", "")
-	l.input = strings.ReplaceAll(l.input, "\r", "")
-	l.input = strings.ReplaceAll(l.input, " ", "")
+	l := &Lexer{input: input, line: 1, column: 1}
 
 	// Populate the simple token-types in a map for later use.
 	l.known = make(map[string]string)
@@ -127,10 +148,13 @@ func (l *Lexer) Next() *Token {
 			//
 			// If not just return this single instance.
 			//
+			tok := &Token{Type: char, Repeat: 1, Offset: l.position, Line: l.line, Column: l.column}
+
 			repeated := l.repeat[char]
 			if !repeated {
-				l.position++
-				return &Token{Type: char, Repeat: 1}
+				l.advance()
+				tok.End = l.position
+				return tok
 			}
 
 			//
@@ -140,39 +164,76 @@ func (l *Lexer) Next() *Token {
 			// We count how many times that repetition
 			// occurs, swallowing that input as we go.
 			//
+			// Newlines and spaces between the repeated
+			// characters are ignored, so "+ +" is treated
+			// the same as "++".
+			//
+			l.advance()
+			tok.End = l.position
 
-			// Record our starting position
-			begin := l.position
-
-			// Loop forward to see how many times the character
-			// is repeated.
 			for l.position < len(l.input) {
 
+				// Skip over any whitespace
+				ahead := l.position
+				for ahead < len(l.input) && isSpace(l.input[ahead]) {
+					ahead++
+				}
+
 				// If it isn't the same character
 				// we're done
-				if string(l.input[l.position]) != char {
+				if ahead >= len(l.input) || string(l.input[ahead]) != char {
 					break
 				}
 
 				// Otherwise keep advancing forward
-				l.position++
+				for l.position <= ahead {
+					l.advance()
+				}
+				tok.Repeat++
+				tok.End = l.position
 			}
 
 			// Return the token and the times it was
 			// seen in adjacent positions
-			count := l.position - begin
-			return &Token{Type: char, Repeat: count}
+			return tok
 		}
 
 		//
 		// Here we're ignoring a token which was unknown.
 		//
-		l.position++
+		l.advance()
 	}
 
 	//
 	// If we got here then we're at/after the end of our input
 	// string.  So we just return EOF.
 	//
-	return &Token{Type: EOF, Repeat: 1}
+	return &Token{Type: EOF, Repeat: 1, Offset: l.position, End: l.position, Line: l.line, Column: l.column}
+}
+
+// advance moves forward a single byte in our input, keeping track
+// of the line and column as we go.
+func (l *Lexer) advance() {
+
+	c := l.input[l.position]
+	l.position++
+
+	// Newlines start a new line.
+	if c == '\n' {
+		l.line++
+		l.column = 1
+		return
+	}
+
+	// UTF-8 continuation bytes are part of the previous character,
+	// so they don't count towards the column.
+	if c&0xC0 != 0x80 {
+		l.column++
+	}
+}
+
+// isSpace returns true if the given character is whitespace which
+// may appear between repeated characters.
+func isSpace(c byte) bool {
+	return c == '\n' || c == '\r' || c == ' '
 }
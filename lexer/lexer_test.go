@@ -60,3 +60,40 @@ func TestAdjacent(t *testing.T) {
 		}
 	}
 }
+
+// TestPositions ensures that tokens record where they were found.
+func TestPositions(t *testing.T) {
+
+	tests := []struct {
+		expectedType   string
+		expectedCount  int
+		expectedOffset int
+		expectedEnd    int
+		expectedLine   int
+		expectedColumn int
+	}{
+		{INC_CELL, 3, 0, 4, 1, 1},
+		{LOOP_OPEN, 1, 9, 10, 3, 3},
+		{DEC_PTR, 2, 15, 17, 3, 8},
+		{LOOP_CLOSE, 1, 17, 18, 3, 10},
+		{EOF, 1, 19, 19, 4, 1},
+	}
+
+	l := New("++\n+ #\n  [é x <<]\n")
+
+	for i, tt := range tests {
+		tok := l.Next()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Repeat != tt.expectedCount {
+			t.Fatalf("tests[%d] - count wrong, expected=%d, got=%d", i, tt.expectedCount, tok.Repeat)
+		}
+		if tok.Offset != tt.expectedOffset || tok.End != tt.expectedEnd {
+			t.Fatalf("tests[%d] - offsets wrong, expected=%d-%d, got=%d-%d", i, tt.expectedOffset, tt.expectedEnd, tok.Offset, tok.End)
+		}
+		if tok.Line != tt.expectedLine || tok.Column != tt.expectedColumn {
+			t.Fatalf("tests[%d] - position wrong, expected=%d:%d, got=%d:%d", i, tt.expectedLine, tt.expectedColumn, tok.Line, tok.Column)
+		}
+	}
+}
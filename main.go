@@ -1,7 +1,7 @@
 // bfcc is a trivial compiler for converting BrainFuck programs into
 // executables.
 //
-// The bfcc compiler contains a pair of backends which can be used to generate
+// The bfcc compiler contains several backends which can be used to generate
 // executables.
 //
 // There is a backend named `asm` which converts the input program into an
@@ -10,58 +10,159 @@
 // Then there is a second backend named `c` which converts the input-program
 // into a C source-file, and then also compiles it via `gcc`.
 //
-// The end result of either approach should be a working, native, executable
+// Finally there is a backend named `elf` which generates the same code as
+// the `asm` backend, but writes the executable itself without using `gcc`.
+//
+// The end result of each approach should be a working, native, executable
 // which can be executed to run the brainfuck program.
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"strings"
 
 	"github.com/skx/bfcc/generators"
+	"github.com/skx/bfcc/ir"
+	"github.com/skx/bfcc/lexer"
 )
 
 func main() {
 
+	//
+	// Our defaults.
+	//
+	defaults := generators.DefaultOptions()
+
 	//
 	// Parse command-line flags
 	//
 	backend := flag.String("backend", "asm", "The backend to use for compilation.")
-	cleanup := flag.Bool("cleanup", true, "Remove the generated files after creation.")
-	debug := flag.Bool("debug", false, "Insert a debugging-breakpoint in the generated file, if possible.")
+	cleanup := flag.Bool("cleanup", defaults.Cleanup, "Remove the generated files after creation, otherwise show where they were written.")
+	debug := flag.Bool("debug", defaults.Debug, "Insert a debugging-breakpoint in the generated file, if possible.")
 	run := flag.Bool("run", false, "Run the program after compiling.")
+	emit := flag.String("emit", "binary", "What to produce; binary, source, ir, or bf.")
+	source := flag.Bool("S", false, "Only generate the source-code, without compiling it, the same as -emit=source.")
+	tape := flag.Int("tape-size", defaults.TapeSize, "The number of cells in the tape.")
+	cells := flag.Int("cell-size", defaults.CellSize, "The width of each cell in bits; 8, 16, 32, or 64.")
+	eof := flag.String("eof", defaults.EOF, "The value stored when reading at EOF; zero, minus-one, or unchanged.")
+	edges := flag.String("tape", defaults.Tape, "What happens at the ends of the tape; fixed, check, wrap, or grow.")
+	check := flag.Bool("bounds-check", false, "Terminate the program if it accesses memory outside the tape, the same as -tape=check.")
+	cc := flag.String("cc", env("CC", defaults.Compiler), "The C compiler to use, defaults to $CC if set.")
+	cflags := flag.String("cflags", os.Getenv("CFLAGS"), "Extra flags to pass to the compiler, defaults to $CFLAGS.")
+	ldflags := flag.String("ldflags", strings.Join(defaults.LDFlags, " "), "The flags to use when linking.")
+	o0 := flag.Bool("O0", false, "Disable all optimizations.")
+	o1 := flag.Bool("O1", false, "Enable only simple optimizations.")
+	o2 := flag.Bool("O2", false, "Enable all optimizations (default).")
 	flag.Parse()
 
+	//
+	// Work out the optimization level.
+	//
+	level := defaults.Optimization
+	count := 0
+	if *o0 {
+		level = ir.O0
+		count++
+	}
+	if *o1 {
+		level = ir.O1
+		count++
+	}
+	if *o2 {
+		level = ir.O2
+		count++
+	}
+	if count > 1 {
+		fmt.Fprintf(os.Stderr, "Only one of -O0, -O1, and -O2 may be specified.\n")
+		os.Exit(1)
+	}
+
+	if *check {
+		if *edges == generators.TapeWrap || *edges == generators.TapeGrow {
+			fmt.Fprintf(os.Stderr, "The -bounds-check flag cannot be used with -tape=%s.\n", *edges)
+			os.Exit(1)
+		}
+		*edges = generators.TapeCheck
+	}
+
+	if *source {
+		if *emit != "binary" && *emit != "source" {
+			fmt.Fprintf(os.Stderr, "The -S flag cannot be used with -emit=%s.\n", *emit)
+			os.Exit(1)
+		}
+		*emit = "source"
+	}
+
+	if *emit != "binary" && *emit != "source" && *emit != "ir" && *emit != "bf" {
+		fmt.Fprintf(os.Stderr, "The emit-mode must be one of binary, source, ir, or bf.\n")
+		os.Exit(1)
+	}
+
+	if *run && *emit != "binary" {
+		fmt.Fprintf(os.Stderr, "The -run flag can only be used when generating a binary.\n")
+		os.Exit(1)
+	}
+
+	//
+	// Build up the options for our backend, and ensure
+	// they're valid.
+	//
+	options := generators.Options{
+		Cleanup:      *cleanup,
+		Debug:        *debug,
+		TapeSize:     *tape,
+		CellSize:     *cells,
+		Optimization: level,
+		EOF:          *eof,
+		Tape:         *edges,
+		Compiler:     *cc,
+		CFlags:       strings.Fields(*cflags),
+		LDFlags:      strings.Fields(*ldflags),
+	}
+	err := options.Validate()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid options: %s\n", err.Error())
+		os.Exit(1)
+	}
+
 	//
 	// Ensure the backend we have is available
 	//
 	helper := generators.GetGenerator(*backend)
 	if helper == nil {
 
-		fmt.Printf("Unknown backend %s - valid backends are:\n", *backend)
+		fmt.Fprintf(os.Stderr, "Unknown backend %s - valid backends are:\n", *backend)
 		all := generators.Available()
 		for _, name := range all {
-			fmt.Printf("\t%s\n", name)
+			fmt.Fprintf(os.Stderr, "\t%s\n", name)
 		}
-		return
+		os.Exit(1)
 	}
 
 	//
 	// Ensure we have an input filename
 	//
 	if len(flag.Args()) < 1 {
-		fmt.Printf("Usage: bfcc [flags] input.file.bf [outfile]\n")
-		return
+		fmt.Fprintf(os.Stderr, "Usage: bfcc [flags] input.file.bf [outfile]\n")
+		os.Exit(1)
 	}
 
 	//
 	// Input and output files
 	//
+	// When we're not generating a binary our output goes to
+	// STDOUT, unless a file is named.
+	//
 	input := flag.Args()[0]
 	output := "a.out"
+	if *emit != "binary" {
+		output = "-"
+	}
 	if len(flag.Args()) == 2 {
 		output = flag.Args()[1]
 	}
@@ -71,36 +172,102 @@ func main() {
 	//
 	prog, err := ioutil.ReadFile(input)
 	if err != nil {
-		fmt.Printf("failed to read %s: %s\n", input, err.Error())
+		fmt.Fprintf(os.Stderr, "failed to read %s: %s\n", input, err.Error())
+		os.Exit(1)
 	}
 
 	//
-	// Will we cleanup ?
+	// Ensure the program is valid before we pass it to the backend.
 	//
-	if *cleanup {
-		os.Setenv("CLEANUP", "1")
-	} else {
-		os.Setenv("CLEANUP", "0")
+	// This will report all unmatched brackets, along with their
+	// positions.
+	//
+	err = ir.Validate(input, string(prog))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
 	}
 
 	//
-	// Will we setup a debug-breakpoint?
+	// Are we dumping our intermediate form?  That happens
+	// before any backend is involved.
 	//
-	// This only makes sense for the ASM-backend.
+	if *emit == "ir" || *emit == "bf" {
+		var text string
+		var program []*ir.Instruction
+		program, err = ir.Parse(lexer.New(string(prog)).Tokens())
+		if err == nil {
+			program = ir.Optimize(program, level)
+			if *emit == "ir" {
+				text = ir.Dump(program)
+			} else {
+				text, err = ir.Brainfuck(program)
+			}
+		}
+		if err == nil {
+			err = writeText(output, text)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error generating %s: %s\n", *emit, err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	//
+	// Are we only generating source-code?
 	//
-	if *debug {
-		os.Setenv("DEBUG", "1")
-	} else {
-		os.Setenv("DEBUG", "0")
+	if *emit == "source" {
+		gen, ok := helper.(generators.SourceGenerator)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "The %s backend does not generate source-code.\n", *backend)
+			os.Exit(1)
+		}
+
+		var src string
+		src, err = gen.Source(string(prog), options)
+		if err == nil {
+			err = writeText(output, src)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error generating source: %s\n", err.Error())
+			os.Exit(1)
+		}
+		return
 	}
 
 	//
 	// Generate the compiled version
 	//
-	err = helper.Generate(string(prog), output)
+	err = helper.Generate(string(prog), output, options)
+
+	//
+	// If we kept the generated source, even if it failed to
+	// compile, then show where it is.
+	//
+	if gen, ok := helper.(generators.KeptSourceGenerator); ok && gen.KeptSource() != "" {
+		fmt.Fprintf(os.Stderr, "generated source file at %s\n", gen.KeptSource())
+	}
+
 	if err != nil {
-		fmt.Printf("error generating binary: %s\n", err.Error())
-		return
+
+		//
+		// The interpreter reports out of bounds accesses
+		// in the same way as a compiled program would.
+		//
+		var bounds *generators.BoundsError
+		if errors.As(err, &bounds) {
+			fmt.Fprintf(os.Stderr, "%s\n", bounds.Error())
+			os.Exit(generators.BoundsExitCode)
+		}
+
+		//
+		// Anything else is fatal; the backends report
+		// problems with the program, such as unsupported
+		// tokens, with their position.
+		//
+		fmt.Fprintf(os.Stderr, "error generating binary: %s\n", err.Error())
+		os.Exit(1)
 	}
 
 	//
@@ -113,9 +280,37 @@ func main() {
 		exe.Stderr = os.Stderr
 		err = exe.Run()
 		if err != nil {
-			fmt.Printf("Error launching %s: %s\n", output, err)
+
+			// If the program ran, but failed, then
+			// return its exit-code as our own.
+			var exit *exec.ExitError
+			if errors.As(err, &exit) {
+				os.Exit(exit.ExitCode())
+			}
+
+			fmt.Fprintf(os.Stderr, "Error launching %s: %s\n", output, err)
 			os.Exit(1)
 		}
 
 	}
 }
+
+// writeText writes the given text to the named file, or to STDOUT if the
+// name is "-".
+func writeText(path string, text string) error {
+	if path == "-" {
+		_, err := os.Stdout.WriteString(text)
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(text), 0644)
+}
+
+// env returns the value of the named environment variable, or the
+// given default if it is unset or empty.
+func env(name string, def string) string {
+	val := os.Getenv(name)
+	if val == "" {
+		return def
+	}
+	return val
+}